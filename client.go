@@ -1,20 +1,150 @@
 package sup
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
 )
 
+// Client runs tasks on a single host, one task at a time.
+// Run starts the task, its I/O is then available via Stdin, Stdout
+// and Stderr until both outputs reach EOF, and Wait waits for it to finish.
 type Client interface {
+	// Connect connects to the host, ie. "scheme://user@example.com:22".
 	Connect(host string) error
+	// Run starts the task.Run command on the host.
 	Run(task *Task) error
+	// Wait waits for the running task to exit.
 	Wait() error
+	// Close closes the connection to the host.
 	Close() error
+	// Prefix returns the (colored) prefix of the host's output lines
+	// and its printable length.
 	Prefix() (string, int)
-	Write(p []byte) (n int, err error)
-	WriteClose() error
+	// Stdin returns the running task's STDIN.
 	Stdin() io.WriteCloser
+	// Stderr returns the running task's STDERR.
 	Stderr() io.Reader
+	// Stdout returns the running task's STDOUT.
 	Stdout() io.Reader
+	// Signal sends the signal to the running task.
 	Signal(os.Signal) error
 }
+
+// forker is implemented by clients, which can run another task concurrently
+// over the same connection to the host, see runner.acquire.
+type forker interface {
+	// fork returns new client sharing the connection and env of the client.
+	fork() Client
+}
+
+// fork returns new client sharing the connection of the client,
+// or false, if the client doesn't support it.
+func fork(c Client) (Client, bool) {
+	f, ok := c.(forker)
+	if !ok {
+		return nil, false
+	}
+	return f.fork(), true
+}
+
+// killer is implemented by clients, which can stop the running task right
+// away, unblocking its I/O and Wait without waiting for the command to exit.
+type killer interface {
+	kill() error
+}
+
+// kill stops the client's running task right away, if the client supports it.
+// Otherwise, the task is sent os.Kill.
+func kill(c Client) error {
+	if k, ok := c.(killer); ok {
+		return k.kill()
+	}
+	return c.Signal(os.Kill)
+}
+
+// ClientOptions are passed to a ClientFactory by Stackup.Run.
+type ClientOptions struct {
+	Env    string      // Env vars exported before every task, ie. `export FOO="bar";`.
+	User   string      // Default user of the network.
+	Color  string      // Color of the host prefix.
+	Dialer SSHDialFunc // Dials SSH connections through the bastion host, if any.
+}
+
+// ClientFactory creates a new, not yet connected, Client for the host.
+type ClientFactory func(host string, opts ClientOptions) (Client, error)
+
+var (
+	clientFactoriesMu sync.RWMutex
+	clientFactories   = map[string]ClientFactory{}
+)
+
+// RegisterClient makes a Client available for hosts of the form "scheme://...".
+// Registering a scheme again replaces the previous factory.
+func RegisterClient(scheme string, factory ClientFactory) {
+	clientFactoriesMu.Lock()
+	defer clientFactoriesMu.Unlock()
+
+	clientFactories[scheme] = factory
+}
+
+// NewClient creates a new Client for the host, chosen by the host's URL scheme.
+// Hosts without a scheme use "ssh://", except for "localhost" using "local://".
+func NewClient(host string, opts ClientOptions) (Client, error) {
+	scheme := hostScheme(host)
+
+	clientFactoriesMu.RLock()
+	factory, ok := clientFactories[scheme]
+	clientFactoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%v: unsupported host scheme %q", host, scheme)
+	}
+
+	return factory(host, opts)
+}
+
+// hostScheme returns URL scheme of the host.
+func hostScheme(host string) string {
+	if host == "localhost" {
+		return "local"
+	}
+	if i := strings.Index(host, "://"); i != -1 {
+		return host[:i]
+	}
+	return "ssh"
+}
+
+func init() {
+	RegisterClient("ssh", func(host string, opts ClientOptions) (Client, error) {
+		return &SSHClient{
+			env:    opts.Env,
+			user:   opts.User,
+			color:  opts.Color,
+			dialer: opts.Dialer,
+		}, nil
+	})
+
+	RegisterClient("local", func(host string, opts ClientOptions) (Client, error) {
+		return &LocalhostClient{
+			env: opts.Env,
+		}, nil
+	})
+
+	RegisterClient("docker", func(host string, opts ClientOptions) (Client, error) {
+		return &DockerClient{
+			env:    opts.Env,
+			user:   opts.User,
+			color:  opts.Color,
+			dialer: opts.Dialer,
+		}, nil
+	})
+
+	RegisterClient("k8s", func(host string, opts ClientOptions) (Client, error) {
+		return &KubernetesClient{
+			env:   opts.Env,
+			color: opts.Color,
+		}, nil
+	})
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -23,6 +25,13 @@ var (
 	sshConfig   string
 	onlyHosts   string
 	exceptHosts string
+	socksPort   int
+	resume      bool
+	forceUnlock bool
+	logDir      string
+	output      string
+	quiet       bool
+	jsonOutput  bool
 
 	debug         bool
 	disablePrefix bool
@@ -30,7 +39,9 @@ var (
 	showVersion bool
 	showHelp    bool
 
-	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [ --help | -v | --version ]")
+	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [OPTIONS] NETWORK ssh [HOST-REGEXP]\n       sup [OPTIONS] list [networks | hosts [NETWORK] | commands | targets]\n       sup [OPTIONS] validate\n       sup schema [VERSION]\n       sup [ --help | -v | --version ]")
+	ErrUsageSSH         = errors.New("Usage: sup [OPTIONS] NETWORK ssh [HOST-REGEXP]")
+	ErrUsageList        = errors.New("Usage: sup [OPTIONS] list [networks | hosts [NETWORK] | commands | targets]")
 	ErrUnknownNetwork   = errors.New("Unknown network")
 	ErrNetworkNoHosts   = errors.New("No hosts defined for a given network")
 	ErrCmd              = errors.New("Unknown command/target")
@@ -56,6 +67,14 @@ func init() {
 	flag.StringVar(&sshConfig, "sshconfig", "", "Read SSH Config file, ie. ~/.ssh/config file")
 	flag.StringVar(&onlyHosts, "only", "", "Filter hosts using regexp")
 	flag.StringVar(&exceptHosts, "except", "", "Filter out hosts using regexp")
+	flag.IntVar(&socksPort, "socks", 0, "Serve SOCKS5/HTTP proxy on remote hosts' localhost:PORT")
+	flag.StringVar(&logDir, "log-dir", "", "Write output of each host and command to DIR/<run-id>/<host>/<command>.log")
+	flag.StringVar(&output, "output", sup.OutputStream, "Print output as it comes (stream), per host (grouped) or per identical output (diff)")
+	flag.BoolVar(&quiet, "q", false, "Print output of failed hosts only, display progress instead")
+	flag.BoolVar(&quiet, "quiet", false, "Print output of failed hosts only, display progress instead")
+	flag.BoolVar(&forceUnlock, "force-unlock", false, "Remove the network's lock left by another run")
+	flag.BoolVar(&resume, "resume", false, "Resume the last failed run on the hosts that didn't complete it")
+	flag.BoolVar(&jsonOutput, "json", false, "Print sup list output in JSON")
 
 	flag.BoolVar(&debug, "D", false, "Enable debug mode")
 	flag.BoolVar(&debug, "debug", false, "Enable debug mode")
@@ -92,8 +111,8 @@ func cmdUsage(conf *sup.Supfile) {
 	// Print available targets/commands.
 	fmt.Fprintln(w, "Targets:\t")
 	for _, name := range conf.Targets.Names {
-		cmds, _ := conf.Targets.Get(name)
-		fmt.Fprintf(w, "- %v\t%v\n", name, strings.Join(cmds, " "))
+		target, _ := conf.Targets.Get(name)
+		fmt.Fprintf(w, "- %v\t%v\n", name, strings.Join(target.Commands, " "))
 	}
 	fmt.Fprintln(w, "\t")
 	fmt.Fprintln(w, "Commands:\t")
@@ -106,10 +125,7 @@ func cmdUsage(conf *sup.Supfile) {
 
 // parseArgs parses args and returns network and commands to be run.
 // On error, it prints usage and exits.
-func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
-	var commands []*sup.Command
-
-	args := flag.Args()
+func parseArgs(conf *sup.Supfile, args []string) (*sup.Network, []*sup.Command, error) {
 	if len(args) < 1 {
 		networkUsage(conf)
 		return nil, nil, ErrUsage
@@ -122,20 +138,7 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 		return nil, nil, ErrUnknownNetwork
 	}
 
-	// Parse CLI --env flag env vars, override values defined in Network env.
-	for _, env := range envVars {
-		if len(env) == 0 {
-			continue
-		}
-		i := strings.Index(env, "=")
-		if i < 0 {
-			if len(env) > 0 {
-				network.Env.Set(env, "")
-			}
-			continue
-		}
-		network.Env.Set(env[:i], env[i+1:])
-	}
+	setEnvVars(&network)
 
 	hosts, err := network.ParseInventory()
 	if err != nil {
@@ -176,38 +179,98 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 		network.Env.Set("SUP_USER", os.Getenv("USER"))
 	}
 
-	for _, cmd := range args[1:] {
-		// Target?
-		target, isTarget := conf.Targets.Get(cmd)
-		if isTarget {
-			// Loop over target's commands.
-			for _, cmd := range target {
-				command, isCommand := conf.Commands.Get(cmd)
-				if !isCommand {
-					cmdUsage(conf)
-					return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
-				}
-				command.Name = cmd
-				commands = append(commands, &command)
-			}
+	// Built-in rollback of the releases, unless the Supfile defines its own.
+	if len(args) == 2 && builtin(conf, args, "rollback") {
+		command, err := conf.ReleaseRollback()
+		if err != nil {
+			return nil, nil, err
 		}
+		return &network, []*sup.Command{command}, nil
+	}
 
-		// Command?
-		command, isCommand := conf.Commands.Get(cmd)
-		if isCommand {
-			command.Name = cmd
-			commands = append(commands, &command)
+	// Built-in interactive shell on the host matching the regexp,
+	// picked by main after the other filters. No commands are run.
+	if builtin(conf, args, "ssh") {
+		if len(args) > 3 {
+			return nil, nil, ErrUsageSSH
+		}
+		if len(args) == 3 {
+			expr, err := regexp.CompilePOSIX(args[2])
+			if err != nil {
+				return nil, nil, err
+			}
+			var hosts []string
+			for _, host := range network.Hosts {
+				if expr.MatchString(host) {
+					hosts = append(hosts, host)
+				}
+			}
+			if len(hosts) == 0 {
+				return nil, nil, fmt.Errorf("no hosts match '%v' regexp", args[2])
+			}
+			network.Hosts = hosts
 		}
+		return &network, nil, nil
+	}
 
+	for _, cmd := range args[1:] {
+		_, isTarget := conf.Targets.Get(cmd)
+		_, isCommand := conf.Commands.Get(cmd)
 		if !isTarget && !isCommand {
 			cmdUsage(conf)
 			return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
 		}
 	}
 
+	// Expand targets and dependencies of the commands.
+	commands, err := conf.Resolve(args[1:]...)
+	if err != nil {
+		cmdUsage(conf)
+		return nil, nil, err
+	}
+
 	return &network, commands, nil
 }
 
+// setEnvVars sets CLI --env flag env vars, overriding values defined in Network env.
+func setEnvVars(network *sup.Network) {
+	for _, env := range envVars {
+		if len(env) == 0 {
+			continue
+		}
+		i := strings.Index(env, "=")
+		if i < 0 {
+			if len(env) > 0 {
+				network.Env.Set(env, "")
+			}
+			continue
+		}
+		network.Env.Set(env[:i], env[i+1:])
+	}
+}
+
+// hasNetwork reports whether the Supfile defines the network. Supfile,
+// which can't be parsed, defines none.
+func hasNetwork(data []byte, name string) bool {
+	conf, err := sup.NewSupfile(data)
+	if err != nil {
+		return false
+	}
+	_, ok := conf.Networks.Get(name)
+	return ok
+}
+
+// builtin reports whether the args run the built-in command,
+// ie. the Supfile defines no command or target of the same name.
+func builtin(conf *sup.Supfile, args []string, name string) bool {
+	if len(args) < 2 || args[1] != name {
+		return false
+	}
+	_, isTarget := conf.Targets.Get(name)
+	_, isCommand := conf.Commands.Get(name)
+	return !isTarget && !isCommand
+}
+
 func resolvePath(path string) string {
 	if path == "" {
 		return ""
@@ -238,24 +301,92 @@ func main() {
 	if supfile == "" {
 		supfile = "./Supfile"
 	}
-	data, err := ioutil.ReadFile(resolvePath(supfile))
+	path := resolvePath(supfile)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		firstErr := err
-		data, err = ioutil.ReadFile("./Supfile.yml") // Alternative to ./Supfile.
+		path = "./Supfile.yml" // Alternative to ./Supfile.
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			err = fmt.Errorf("%v\n%v", firstErr, err)
+		}
+	}
+
+	// Print JSON Schema of the Supfile, unless it defines network
+	// of the same name. No Supfile needed.
+	if flag.NArg() >= 1 && flag.NArg() <= 2 && flag.Arg(0) == "schema" && (err != nil || !hasNetwork(data, "schema")) {
+		version := sup.LatestVersion
+		if flag.NArg() == 2 {
+			version = strings.TrimPrefix(flag.Arg(1), "v")
+		}
+		schema, err := sup.Schema(version)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, firstErr)
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		fmt.Println(string(schema))
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+
+	// Validate the Supfile, reporting all of its problems,
+	// unless it defines network of the same name.
+	if flag.NArg() == 1 && flag.Arg(0) == "validate" && !hasNetwork(data, "validate") {
+		problems := sup.Validate(data)
+		for _, p := range problems {
+			if p.Line == 0 {
+				fmt.Fprintf(os.Stderr, "%v: %v\n", path, p.Message)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%v:%v\n", path, p)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	conf, err := sup.NewSupfile(data)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	// Built-in listing of the Supfile, unless it defines network of the same name.
+	args := flag.Args()
+	if _, ok := conf.Networks.Get("list"); len(args) > 0 && args[0] == "list" && !ok {
+		if err := list(conf, args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// --resume flag continues the failed run recorded in the state file.
+	stateFile := filepath.Join(filepath.Dir(resolvePath(supfile)), ".sup-state.json")
+	var state *sup.State
+	if resume {
+		if len(args) > 0 {
+			fmt.Fprintln(os.Stderr, "--resume runs the network and commands of the failed run, no arguments expected")
+			os.Exit(1)
+		}
+		state, err = sup.LoadState(stateFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		args = append([]string{state.Network}, state.Args...)
+		envVars = flagStringSlice(state.Env)
+		os.Setenv("SUP_TIME", state.Time)
+		fmt.Fprintf(os.Stderr, "resuming %v from %v\n", strings.Join(args, " "), state.Time)
+	}
+
 	// Parse network and commands to be run from args.
-	network, commands, err := parseArgs(conf)
+	network, commands, err := parseArgs(conf, args)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -331,6 +462,33 @@ func main() {
 		}
 	}
 
+	// Interactive shell doesn't record any progress.
+	shell := builtin(conf, args, "ssh")
+
+	// Resumed run continues on the same hosts.
+	if shell {
+		state = nil
+	} else if state != nil {
+		network.Hosts = state.Hosts
+	} else {
+		state = sup.NewState(stateFile)
+		state.Network = args[0]
+		state.Args = args[1:]
+		state.Env = envVars
+		state.Hosts = network.Hosts
+		for _, v := range network.Env {
+			if v.Key == "SUP_TIME" {
+				state.Time = v.Value
+			}
+		}
+	}
+	if state != nil {
+		if err := state.Save(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			state = nil
+		}
+	}
+
 	var vars sup.EnvList
 	for _, val := range append(conf.Env, network.Env...) {
 		vars.Set(val.Key, val.Value)
@@ -373,11 +531,369 @@ func main() {
 	}
 	app.Debug(debug)
 	app.Prefix(!disablePrefix)
+	app.Socks(socksPort)
+	app.ForceUnlock(forceUnlock)
+	app.LogDir(logDir)
+	app.Quiet(quiet)
+	if err := app.Output(output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if state != nil {
+		app.State(state)
+	}
+
+	// Open the shell on the single host left, exit with its exit status.
+	if shell {
+		if len(network.Hosts) != 1 {
+			fmt.Fprintf(os.Stderr, "%v hosts match, narrow them down to one with HOST-REGEXP, --only or --except: %v\n", len(network.Hosts), strings.Join(network.Hosts, ", "))
+			os.Exit(1)
+		}
+		err := app.Shell(network, vars, network.Hosts[0])
+		if e, ok := err.(sup.ErrTaskFailed); ok {
+			os.Exit(e.ExitStatus)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Run all the commands in the given network.
-	err = app.Run(network, vars, commands...)
+	report, err := app.RunReport(network, vars, commands...)
+	if report != nil {
+		printSummary(report)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		if e, ok := errors.Cause(err).(sup.ErrTaskFailed); ok {
+			os.Exit(e.ExitStatus)
+		}
 		os.Exit(1)
 	}
+
+	// Nothing to be resumed.
+	if state != nil {
+		state.Remove()
+	}
+}
+
+// printSummary prints table of the results of the run on each host.
+func printSummary(report *sup.Report) {
+	hosts := report.Hosts()
+	if len(hosts) == 0 {
+		return
+	}
+
+	ok, failed := 0, 0
+	w := &tabwriter.Writer{}
+	w.Init(os.Stderr, 4, 4, 2, ' ', 0)
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(w, "HOST\tOK\tFAILED\tSKIPPED\tEXIT\tDURATION\t")
+	for _, h := range hosts {
+		switch {
+		case h.HostIndex < 0:
+			// Local commands don't count as any of the hosts.
+		case h.Failed > 0:
+			failed++
+		default:
+			ok++
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t\n", summaryHost(h), h.OK, h.Failed, h.Skipped, h.ExitStatus, h.Duration.Round(time.Millisecond))
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "%v ok, %v failed in %v\n", ok, failed, report.Duration.Round(time.Millisecond))
+
+	var interrupted []string
+	for _, h := range hosts {
+		if h.Interrupted {
+			interrupted = append(interrupted, summaryHost(h))
+		}
+	}
+	if len(interrupted) > 0 {
+		fmt.Fprintf(os.Stderr, "interrupted on %v host(s): %v\n", len(interrupted), strings.Join(interrupted, ", "))
+	}
+
+	for _, h := range hosts {
+		if len(h.Stderr) == 0 {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "\n%v:\n", summaryHost(h))
+		for _, line := range h.Stderr {
+			fmt.Fprintf(os.Stderr, "    %v\n", line)
+		}
+	}
+}
+
+// listNetwork is a network printed by sup list.
+type listNetwork struct {
+	Name    string   `json:"name"`
+	Hosts   []string `json:"hosts"`
+	Bastion string   `json:"bastion,omitempty"`
+	Error   string   `json:"error,omitempty"` // Running the inventory failed.
+}
+
+// listHost is a host printed by sup list hosts.
+type listHost struct {
+	Network string `json:"network"`
+	Host    string `json:"host"`
+}
+
+// listCommand is a command printed by sup list.
+type listCommand struct {
+	Name      string   `json:"name"`
+	Desc      string   `json:"desc,omitempty"`
+	Once      bool     `json:"once,omitempty"`
+	Serial    []string `json:"serial,omitempty"`
+	Stdin     bool     `json:"stdin,omitempty"`
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// listTarget is a target printed by sup list, with all of its commands
+// and their dependencies, in the order they are run.
+type listTarget struct {
+	Name     string   `json:"name"`
+	Commands []string `json:"commands"`
+	Serial   []string `json:"serial,omitempty"`
+	Parallel bool     `json:"parallel,omitempty"`
+	Error    string   `json:"error,omitempty"` // Resolving the commands failed.
+}
+
+// list prints the Supfile's networks, hosts, commands and targets,
+// or all of them, as text or JSON (--json flag).
+func list(conf *sup.Supfile, args []string) error {
+	kind := ""
+	if len(args) > 0 {
+		kind = args[0]
+	}
+	if len(args) > 2 || (len(args) == 2 && kind != "hosts") {
+		return ErrUsageList
+	}
+
+	switch kind {
+	case "":
+		all := struct {
+			Networks []listNetwork `json:"networks"`
+			Commands []listCommand `json:"commands"`
+			Targets  []listTarget  `json:"targets"`
+		}{listNetworks(conf, conf.Networks.Names), listCommands(conf), listTargets(conf)}
+		if jsonOutput {
+			return printJSON(all)
+		}
+		printNetworks(all.Networks)
+		fmt.Println()
+		printCommands(all.Commands)
+		fmt.Println()
+		printTargets(all.Targets)
+
+	case "networks":
+		networks := listNetworks(conf, conf.Networks.Names)
+		if jsonOutput {
+			return printJSON(networks)
+		}
+		printNetworks(networks)
+
+	case "hosts":
+		names := conf.Networks.Names
+		if len(args) == 2 {
+			if _, ok := conf.Networks.Get(args[1]); !ok {
+				return errors.Wrap(ErrUnknownNetwork, args[1])
+			}
+			names = args[1:]
+		}
+		networks := listNetworks(conf, names)
+		hosts := []listHost{}
+		for _, n := range networks {
+			if n.Error != "" {
+				fmt.Fprintf(os.Stderr, "%v: %v\n", n.Name, n.Error)
+			}
+			for _, host := range n.Hosts {
+				hosts = append(hosts, listHost{Network: n.Name, Host: host})
+			}
+		}
+		if jsonOutput {
+			return printJSON(hosts)
+		}
+		// Hosts of the given network are printed one per line, ie. for scripts.
+		if len(args) == 2 {
+			for _, h := range hosts {
+				fmt.Println(h.Host)
+			}
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NETWORK\tHOST")
+		for _, h := range hosts {
+			fmt.Fprintf(w, "%v\t%v\n", h.Network, h.Host)
+		}
+		w.Flush()
+
+	case "commands":
+		commands := listCommands(conf)
+		if jsonOutput {
+			return printJSON(commands)
+		}
+		printCommands(commands)
+
+	case "targets":
+		targets := listTargets(conf)
+		if jsonOutput {
+			return printJSON(targets)
+		}
+		printTargets(targets)
+
+	default:
+		return ErrUsageList
+	}
+	return nil
+}
+
+// listNetworks returns the named networks with the hosts listed by their inventory.
+func listNetworks(conf *sup.Supfile, names []string) []listNetwork {
+	networks := []listNetwork{}
+	for _, name := range names {
+		network, _ := conf.Networks.Get(name)
+		setEnvVars(&network)
+		n := listNetwork{
+			Name:    name,
+			Hosts:   append([]string{}, network.Hosts...),
+			Bastion: network.Bastion,
+		}
+		// The inventory's STDERR is reported as error, even if it exits
+		// with zero status, ie. when its failing command is piped.
+		var stderr bytes.Buffer
+		hosts, err := network.ParseInventoryWith(&stderr)
+		msg := strings.Join(strings.Fields(stderr.String()), " ")
+		switch {
+		case err != nil && msg != "":
+			n.Error = fmt.Sprintf("inventory failed: %v: %v", err, msg)
+		case err != nil:
+			n.Error = errors.Wrap(err, "inventory failed").Error()
+		case msg != "":
+			n.Error = "inventory failed: " + msg
+		}
+		n.Hosts = append(n.Hosts, hosts...)
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+// listCommands returns the commands in the Supfile's order.
+func listCommands(conf *sup.Supfile) []listCommand {
+	commands := []listCommand{}
+	for _, name := range conf.Commands.Names {
+		cmd, _ := conf.Commands.Get(name)
+		commands = append(commands, listCommand{
+			Name:      name,
+			Desc:      cmd.Desc,
+			Once:      cmd.Once,
+			Serial:    cmd.Serial,
+			Stdin:     cmd.Stdin,
+			DependsOn: cmd.DependsOn,
+		})
+	}
+	return commands
+}
+
+// listTargets returns the targets with their commands expanded.
+func listTargets(conf *sup.Supfile) []listTarget {
+	targets := []listTarget{}
+	for _, name := range conf.Targets.Names {
+		target, _ := conf.Targets.Get(name)
+		t := listTarget{
+			Name:     name,
+			Commands: []string{},
+			Serial:   target.Serial,
+			Parallel: target.Parallel,
+		}
+		commands, err := conf.Resolve(name)
+		if err != nil {
+			t.Error = err.Error()
+		}
+		for _, cmd := range commands {
+			t.Commands = append(t.Commands, cmd.Name)
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+func printNetworks(networks []listNetwork) {
+	w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "NETWORK\tHOSTS")
+	for _, n := range networks {
+		hosts := []string{strings.Join(n.Hosts, ", ")}
+		if n.Bastion != "" {
+			hosts = append(hosts, "(via "+n.Bastion+")")
+		}
+		if n.Error != "" {
+			hosts = append(hosts, "["+n.Error+"]")
+		}
+		fmt.Fprintf(w, "%v\t%v\n", n.Name, strings.TrimSpace(strings.Join(hosts, " ")))
+	}
+}
+
+func printCommands(commands []listCommand) {
+	w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "COMMAND\tFLAGS\tDESCRIPTION")
+	for _, cmd := range commands {
+		var flags []string
+		if cmd.Once {
+			flags = append(flags, "once")
+		}
+		if len(cmd.Serial) > 0 {
+			flags = append(flags, "serial="+strings.Join(cmd.Serial, ","))
+		}
+		if cmd.Stdin {
+			flags = append(flags, "stdin")
+		}
+		if len(cmd.DependsOn) > 0 {
+			flags = append(flags, "depends_on="+strings.Join(cmd.DependsOn, ","))
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", cmd.Name, strings.Join(flags, " "), cmd.Desc)
+	}
+}
+
+func printTargets(targets []listTarget) {
+	w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "TARGET\tFLAGS\tCOMMANDS")
+	for _, t := range targets {
+		var flags []string
+		if len(t.Serial) > 0 {
+			flags = append(flags, "serial="+strings.Join(t.Serial, ","))
+		}
+		if t.Parallel {
+			flags = append(flags, "parallel")
+		}
+		commands := strings.Join(t.Commands, " ")
+		if t.Error != "" {
+			commands = "[" + t.Error + "]"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", t.Name, strings.Join(flags, " "), commands)
+	}
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// summaryHost returns name of the host in the summary, labeling
+// the local commands, which don't run on any of the hosts.
+func summaryHost(h *sup.HostSummary) string {
+	if h.HostIndex < 0 {
+		return "(local)"
+	}
+	return h.Host
 }
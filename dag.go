@@ -0,0 +1,401 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// item returns kind of the target's entry. Commands take precedence
+// over targets of the same name.
+func (s *Supfile) item(name string) (kind string, ok bool) {
+	if _, ok := s.Commands.Get(name); ok {
+		return "command", true
+	}
+	if _, ok := s.Targets.Get(name); ok {
+		return "target", true
+	}
+	return "", false
+}
+
+// checkCycles returns error, if a target includes itself or a command
+// depends on itself, directly or through other targets and commands.
+func (s *Supfile) checkCycles() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var path []string
+
+	var visit func(kind, name string) error
+	visit = func(kind, name string) error {
+		key := kind + " " + name
+		switch state[key] {
+		case visiting:
+			for i, p := range path {
+				if p == key {
+					return fmt.Errorf("dependency cycle: %v", strings.Join(append(path[i:], key), " -> "))
+				}
+			}
+		case visited:
+			return nil
+		}
+
+		state[key] = visiting
+		path = append(path, key)
+
+		var next []string
+		if kind == "target" {
+			target, _ := s.Targets.Get(name)
+			next = target.Commands
+		} else {
+			cmd, _ := s.Commands.Get(name)
+			next = cmd.DependsOn
+		}
+		for _, n := range next {
+			k, ok := s.item(n)
+			if !ok {
+				continue // Reported by Resolve.
+			}
+			if err := visit(k, n); err != nil {
+				return err
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[key] = visited
+		return nil
+	}
+
+	for _, name := range s.Targets.Names {
+		if err := visit("target", name); err != nil {
+			return err
+		}
+	}
+	for _, name := range s.Commands.Names {
+		if err := visit("command", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve expands the commands and targets, including the nested targets
+// and the commands' dependencies, to a list of commands in topological order.
+// Each command is listed once. Commands of a target depend on the previous
+// entry of the target, unless the target is parallel; the given names depend
+// on each other in the same way. Names of both a target and a command resolve
+// to the target's commands, followed by the command.
+func (s *Supfile) Resolve(names ...string) ([]*Command, error) {
+	r := &resolver{conf: s, cmds: map[string]*Command{}}
+
+	var after []*Command
+	for _, name := range names {
+		var block []*Command
+		target, isTarget := s.Targets.Get(name)
+		if isTarget {
+			cmds, err := r.target(name, target, after, nil, "")
+			if err != nil {
+				return nil, err
+			}
+			block = cmds
+		}
+		if _, isCommand := s.Commands.Get(name); isCommand {
+			prev := after
+			if len(block) > 0 {
+				prev = block
+			}
+			cmds, err := r.command(name, prev, nil, "")
+			if err != nil {
+				return nil, err
+			}
+			block = append(block, cmds...)
+		}
+		if !isTarget && len(block) == 0 {
+			return nil, fmt.Errorf("unknown command %v", name)
+		}
+		if len(block) > 0 {
+			after = block
+		}
+	}
+
+	return r.list, nil
+}
+
+// resolver expands commands and targets, see Supfile.Resolve.
+type resolver struct {
+	conf *Supfile
+	cmds map[string]*Command // Commands resolved so far.
+	list []*Command          // Commands resolved so far, in order.
+}
+
+// command resolves the command and its dependencies, all to be run after
+// the given commands. It returns the resolved command.
+func (r *resolver) command(name string, after []*Command, parents []string, target string) ([]*Command, error) {
+	if cmd, ok := r.cmds[name]; ok {
+		return []*Command{cmd}, nil
+	}
+
+	cmd, ok := r.conf.Commands.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown command %v", name)
+	}
+
+	deps := append([]*Command{}, after...)
+	for _, dep := range cmd.DependsOn {
+		cmds, err := r.command(dep, after, parents, target)
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, cmds...)
+	}
+
+	cmd.Name = name
+	cmd.Target = target
+	cmd.deps = deps
+	cmd.parents = parents
+	cmd.resolved = true
+
+	r.cmds[name] = &cmd
+	r.list = append(r.list, &cmd)
+	return []*Command{&cmd}, nil
+}
+
+// target resolves the target's commands, all to be run after the given
+// commands. It returns all the commands of the target. Commands of serial
+// targets and their nested targets are run as a whole, sequentially.
+func (r *resolver) target(name string, t Target, after []*Command, parents []string, serial string) ([]*Command, error) {
+	parents = append(append([]string{}, parents...), name)
+
+	owner := name
+	if serial != "" {
+		owner = serial
+	} else if len(t.Serial) != 0 {
+		serial = name
+	}
+
+	var all []*Command
+	prev := after
+	for _, item := range t.Commands {
+		kind, ok := r.conf.item(item)
+		if !ok {
+			return nil, fmt.Errorf("target %v: unknown command %v", name, item)
+		}
+
+		var block []*Command
+		var err error
+		if kind == "command" {
+			block, err = r.command(item, prev, parents, owner)
+		} else {
+			sub, _ := r.conf.Targets.Get(item)
+			block, err = r.target(item, sub, prev, parents, serial)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, block...)
+		if len(block) > 0 && (!t.Parallel || serial != "") {
+			prev = block
+		}
+	}
+	return all, nil
+}
+
+// inTarget reports whether the command was run by the target,
+// directly or through nested targets.
+func (cmd *Command) inTarget(name string) bool {
+	if cmd.Target == name {
+		return true
+	}
+	for _, p := range cmd.parents {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// node is a unit of the execution graph: a command, or all the commands
+// of a serial target, which are run batch by batch as a whole.
+type node struct {
+	commands []*Command
+	serial   Serial
+	deps     []*node
+}
+
+// graph groups the commands into nodes. Commands, which were not resolved
+// by Supfile.Resolve, depend on the previous command.
+func (r *runner) graph(commands []*Command) []*node {
+	var nodes []*node
+	nodeOf := map[*Command]*node{}
+
+	for i, cmd := range commands {
+		var target Target
+		if cmd.Target != "" && r.sup.conf != nil {
+			target, _ = r.sup.conf.Targets.Get(cmd.Target)
+		}
+
+		// Consecutive commands of a serial target share the node.
+		var n *node
+		if len(target.Serial) != 0 && i > 0 && commands[i-1].Target == cmd.Target {
+			n = nodeOf[commands[i-1]]
+			n.commands = append(n.commands, cmd)
+		} else {
+			n = &node{commands: []*Command{cmd}, serial: target.Serial}
+			nodes = append(nodes, n)
+		}
+		nodeOf[cmd] = n
+
+		deps := cmd.deps
+		if !cmd.resolved && i > 0 {
+			deps = commands[i-1 : i]
+		}
+	loop:
+		for _, dep := range deps {
+			d, ok := nodeOf[dep]
+			if !ok || d == n {
+				continue
+			}
+			for _, existing := range n.deps {
+				if existing == d {
+					continue loop
+				}
+			}
+			n.deps = append(n.deps, d)
+		}
+	}
+
+	return nodes
+}
+
+// runGraph runs the nodes in order of their dependencies. Nodes, which don't
+// depend on each other, are run concurrently on separate sets of clients.
+// On failure, no more nodes are started and the failed run is rolled back,
+// once the running nodes finish.
+func (r *runner) runGraph(nodes []*node) error {
+	type result struct {
+		node *node
+		err  error
+	}
+	results := make(chan result)
+	started := map[*node]bool{}
+	done := map[*node]bool{}
+	running := 0
+
+	var failed *node
+	var firstErr error
+	for {
+		// Start all the nodes, whose dependencies are done.
+		if firstErr == nil && running == 0 {
+			if err := r.interrupted(); err != nil {
+				return err
+			}
+		}
+		for _, n := range nodes {
+			if firstErr != nil || r.interrupted() != nil {
+				break
+			}
+			if started[n] || !n.ready(done) {
+				continue
+			}
+			started[n] = true
+			running++
+			go func(n *node) {
+				results <- result{n, r.runNode(n)}
+			}(n)
+		}
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+		if res.err == nil {
+			done[res.node] = true
+			continue
+		}
+		if firstErr != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", res.err)
+			continue
+		}
+		failed, firstErr = res.node, res.err
+	}
+
+	if firstErr != nil {
+		return r.rollback(failed.commands[0], firstErr)
+	}
+	return nil
+}
+
+// ready reports whether all the node's dependencies are done.
+func (n *node) ready(done map[*node]bool) bool {
+	for _, dep := range n.deps {
+		if !done[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+// runNode runs the node on an idle set of clients.
+func (r *runner) runNode(n *node) error {
+	clients, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer r.release(clients)
+
+	if len(n.serial) != 0 {
+		return r.runSerialTarget(n.commands[0].Target, n.serial, n.commands, clients)
+	}
+	return r.runCommand(n.commands[0], clients)
+}
+
+// acquire returns an idle set of clients of all the hosts. If all of them
+// are busy, the primary set is forked, so that the new set shares its
+// connections with the network's tunnels, forwards and env. New set is
+// connected only if any of the clients can't be forked.
+func (r *runner) acquire() ([]Client, error) {
+	r.mu.Lock()
+	if len(r.idle) > 0 {
+		clients := r.idle[len(r.idle)-1]
+		r.idle = r.idle[:len(r.idle)-1]
+		r.mu.Unlock()
+		return clients, nil
+	}
+	r.mu.Unlock()
+
+	clients := make([]Client, len(r.clients))
+	for i, c := range r.clients {
+		f, ok := fork(c)
+		if !ok {
+			clients = nil
+			break
+		}
+		clients[i] = f
+	}
+	if clients == nil {
+		var err error
+		clients, err = r.connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, c := range clients {
+		r.hosts[c] = i
+	}
+	r.extra = append(r.extra, clients...)
+	return clients, nil
+}
+
+// release marks the set of clients idle.
+func (r *runner) release(clients []Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idle = append(r.idle, clients)
+}
@@ -0,0 +1,149 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DockerClient runs tasks inside of a Docker container via "docker exec -i".
+// The docker CLI runs either on localhost ("docker://container"), or on
+// a remote host over SSH ("docker://[user@]host[:port]/container").
+type DockerClient struct {
+	Client    // LocalhostClient or SSHClient running the docker CLI.
+	name      string
+	container string
+	user      string
+	env       string //export FOO="bar"; export BAR="baz";
+	color     string
+	dialer    SSHDialFunc
+	execID    string
+}
+
+// Connect connects to the host running the docker CLI.
+// It expects the host of the form "docker://[[user@]host[:port]/]container".
+func (c *DockerClient) Connect(host string) error {
+	c.name = strings.TrimPrefix(host, "docker://")
+
+	var remote string
+	c.container = c.name
+	if i := strings.LastIndex(c.name, "/"); i != -1 {
+		remote = c.name[:i]
+		c.container = c.name[i+1:]
+	}
+	if c.container == "" {
+		return ErrConnect{c.user, host, "missing container name"}
+	}
+
+	if remote == "" {
+		local := &LocalhostClient{}
+		if err := local.Connect("localhost"); err != nil {
+			return err
+		}
+		c.Client = local
+		return nil
+	}
+
+	ssh := &SSHClient{
+		user:  c.user,
+		color: c.color,
+	}
+	if c.dialer != nil {
+		if err := ssh.ConnectWith(remote, c.dialer); err != nil {
+			return err
+		}
+	} else {
+		if err := ssh.Connect(remote); err != nil {
+			return err
+		}
+	}
+	c.Client = ssh
+	return nil
+}
+
+// fork returns client running tasks in the same container,
+// sharing the connection to the host running the docker CLI.
+func (c *DockerClient) fork() Client {
+	f := *c
+	f.Client = c.Client.(forker).fork()
+	f.execID = ""
+	return &f
+}
+
+var dockerExecCount uint64
+
+// Run runs the task.Run command inside of the container.
+// The exec'd processes are tagged with $SUP_EXEC_ID, so they can be signaled.
+func (c *DockerClient) Run(task *Task) error {
+	c.execID = fmt.Sprintf("%x-%d", time.Now().UnixNano(), atomic.AddUint64(&dockerExecCount, 1))
+
+	t := *task
+	t.Run = fmt.Sprintf("docker exec -i -e SUP_EXEC_ID=%v %v sh -c %v",
+		c.execID, shellQuote(c.container), shellQuote(c.env+task.Run))
+
+	return c.Client.Run(&t)
+}
+
+// Prefix returns the container name, prefixed with its host.
+func (c *DockerClient) Prefix() (string, int) {
+	host := c.name + " | "
+	return c.color + host + ResetColor, len(host)
+}
+
+// Signal sends the signal to all the processes inside of the container
+// started by the currently running task.
+// kill kills the processes of the running task inside of the container
+// and the docker CLI running it.
+func (c *DockerClient) kill() error {
+	err := c.Signal(os.Kill)
+	kill(c.Client)
+	return err
+}
+
+func (c *DockerClient) Signal(sig os.Signal) error {
+	if c.execID == "" {
+		return fmt.Errorf("no task is running")
+	}
+
+	kill := fmt.Sprintf("docker exec %v sh -c %v", shellQuote(c.container), shellQuote(killTaggedScript(c.execID, sig)))
+	if ssh, ok := c.Client.(*SSHClient); ok {
+		_, err := ssh.execute(kill)
+		return err
+	}
+	return exec.Command("sh", "-c", kill).Run()
+}
+
+// killTaggedScript returns a shell script sending the signal to all processes
+// having the given $SUP_EXEC_ID in their environment.
+func killTaggedScript(execID string, sig os.Signal) string {
+	return fmt.Sprintf(`for p in /proc/[0-9]*; do `+
+		`tr '\0' '\n' < $p/environ 2>/dev/null | grep -qx SUP_EXEC_ID=%v && kill -%v ${p#/proc/}; `+
+		`done; exit 0`, execID, signalName(sig))
+}
+
+// signalName returns name of the signal as understood by kill(1).
+func signalName(sig os.Signal) string {
+	switch sig {
+	case os.Interrupt, syscall.SIGINT:
+		return "INT"
+	case syscall.SIGTERM:
+		return "TERM"
+	case syscall.SIGHUP:
+		return "HUP"
+	case syscall.SIGQUIT:
+		return "QUIT"
+	case os.Kill, syscall.SIGKILL:
+		return "KILL"
+	default:
+		return "TERM"
+	}
+}
+
+// shellQuote quotes the string, so it's passed as a single argument in sh.
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
@@ -0,0 +1,154 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// KubernetesClient runs tasks inside of a Kubernetes pod via "kubectl exec -i".
+// It expects the host of the form "k8s://namespace/pod[/container]".
+type KubernetesClient struct {
+	Client    // LocalhostClient running the kubectl CLI.
+	name      string
+	namespace string
+	pod       string
+	container string
+	env       string //export FOO="bar"; export BAR="baz";
+	color     string
+	execID    string
+}
+
+// Connect parses the pod address. The kubectl CLI runs on localhost
+// with the current kubeconfig context.
+func (c *KubernetesClient) Connect(host string) error {
+	c.name = strings.TrimPrefix(host, "k8s://")
+
+	parts := strings.Split(c.name, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return ErrConnect{"", host, "expected k8s://namespace/pod[/container]"}
+	}
+	c.namespace, c.pod = parts[0], parts[1]
+	if len(parts) == 3 {
+		c.container = parts[2]
+	}
+
+	local := &LocalhostClient{}
+	if err := local.Connect("localhost"); err != nil {
+		return err
+	}
+	c.Client = local
+	return nil
+}
+
+// kubectlExec returns the kubectl command executing args inside of the pod.
+func (c *KubernetesClient) kubectlExec(flags string, args string) string {
+	cmd := fmt.Sprintf("kubectl exec %v -n %v %v", flags, shellQuote(c.namespace), shellQuote(c.pod))
+	if c.container != "" {
+		cmd += " -c " + shellQuote(c.container)
+	}
+	return cmd + " -- " + args
+}
+
+// fork returns client running tasks in the same pod.
+func (c *KubernetesClient) fork() Client {
+	f := *c
+	f.Client = c.Client.(forker).fork()
+	f.execID = ""
+	return &f
+}
+
+var kubectlExecCount uint64
+
+// Run runs the task.Run command inside of the pod.
+// The exec'd processes are tagged with $SUP_EXEC_ID, so they can be signaled.
+func (c *KubernetesClient) Run(task *Task) error {
+	c.execID = fmt.Sprintf("%x-%d", time.Now().UnixNano(), atomic.AddUint64(&kubectlExecCount, 1))
+
+	t := *task
+	t.Run = c.kubectlExec("-i", fmt.Sprintf("env SUP_EXEC_ID=%v sh -c %v", c.execID, shellQuote(c.env+task.Run)))
+
+	return c.Client.Run(&t)
+}
+
+// Prefix returns the pod name, prefixed with its namespace.
+func (c *KubernetesClient) Prefix() (string, int) {
+	host := c.name + " | "
+	return c.color + host + ResetColor, len(host)
+}
+
+// kill kills the processes of the running task inside of the pod
+// and the kubectl CLI running it.
+func (c *KubernetesClient) kill() error {
+	err := c.Signal(os.Kill)
+	kill(c.Client)
+	return err
+}
+
+// Signal sends the signal to all the processes inside of the pod
+// started by the currently running task.
+func (c *KubernetesClient) Signal(sig os.Signal) error {
+	if c.execID == "" {
+		return fmt.Errorf("no task is running")
+	}
+
+	kill := c.kubectlExec("", "sh -c "+shellQuote(killTaggedScript(c.execID, sig)))
+	return exec.Command("sh", "-c", kill).Run()
+}
+
+// PodInventory selects Kubernetes pods to be used as network hosts.
+type PodInventory struct {
+	Namespace string `yaml:"namespace"` // Defaults to the current kubeconfig namespace.
+	Selector  string `yaml:"selector"`  // Label selector, ie. "app=api,tier=backend".
+	Container string `yaml:"container"` // Container to exec into, defaults to the pod's first container.
+}
+
+// Hosts lists running pods matching the label selector
+// and returns them as "k8s://namespace/pod[/container]" hosts.
+func (p *PodInventory) Hosts() ([]string, error) {
+	args := []string{"get", "pods",
+		"--field-selector=status.phase=Running",
+		`-o=jsonpath={range .items[*]}{.metadata.namespace}/{.metadata.name}{"\n"}{end}`,
+	}
+	if p.Namespace != "" {
+		args = append(args, "-n", p.Namespace)
+	}
+	if p.Selector != "" {
+		args = append(args, "-l", p.Selector)
+	}
+
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("kubectl get pods failed: %v", err)
+	}
+
+	var hosts []string
+	buf := bytes.NewBuffer(output)
+	for {
+		pod, err := buf.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		pod = strings.TrimSpace(pod)
+		if pod != "" {
+			host := "k8s://" + pod
+			if p.Container != "" {
+				host += "/" + p.Container
+			}
+			hosts = append(hosts, host)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return hosts, nil
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -15,10 +16,12 @@ type LocalhostClient struct {
 	cmd     *exec.Cmd
 	user    string
 	stdin   io.WriteCloser
-	stdout  io.Reader
-	stderr  io.Reader
+	stdout  io.ReadCloser
+	stderr  io.ReadCloser
 	running bool
 	env     string //export FOO="bar"; export BAR="baz";
+
+	mu sync.Mutex // Guards running, since the task is signaled concurrently.
 }
 
 func (c *LocalhostClient) Connect(_ string) error {
@@ -34,7 +37,10 @@ func (c *LocalhostClient) Connect(_ string) error {
 func (c *LocalhostClient) Run(task *Task) error {
 	var err error
 
-	if c.running {
+	c.mu.Lock()
+	running := c.running
+	c.mu.Unlock()
+	if running {
 		return fmt.Errorf("Command already running")
 	}
 
@@ -60,16 +66,23 @@ func (c *LocalhostClient) Run(task *Task) error {
 		return ErrTask{task, err.Error()}
 	}
 
+	c.mu.Lock()
 	c.running = true
+	c.mu.Unlock()
 	return nil
 }
 
 func (c *LocalhostClient) Wait() error {
-	if !c.running {
+	c.mu.Lock()
+	running := c.running
+	c.mu.Unlock()
+	if !running {
 		return fmt.Errorf("Trying to wait on stopped command")
 	}
 	err := c.cmd.Wait()
+	c.mu.Lock()
 	c.running = false
+	c.mu.Unlock()
 	return err
 }
 
@@ -77,6 +90,14 @@ func (c *LocalhostClient) Close() error {
 	return nil
 }
 
+// fork returns another client running tasks on localhost.
+func (c *LocalhostClient) fork() Client {
+	return &LocalhostClient{
+		user: c.user,
+		env:  c.env,
+	}
+}
+
 func (c *LocalhostClient) Stdin() io.WriteCloser {
 	return c.stdin
 }
@@ -103,9 +124,28 @@ func (c *LocalhostClient) WriteClose() error {
 }
 
 func (c *LocalhostClient) Signal(sig os.Signal) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return fmt.Errorf("command is not running")
+	}
 	return c.cmd.Process.Signal(sig)
 }
 
+// kill kills the running task and closes its output, which is kept open
+// by the task's sub-processes otherwise.
+func (c *LocalhostClient) kill() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return fmt.Errorf("command is not running")
+	}
+	err := c.cmd.Process.Kill()
+	c.stdout.Close()
+	c.stderr.Close()
+	return err
+}
+
 func ResolveLocalPath(cwd, path, env string) (string, error) {
 	// Check if file exists first. Use bash to resolve $ENV_VARs.
 	cmd := exec.Command("bash", "-c", env+"echo -n "+path)
@@ -0,0 +1,215 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Lock is a deploy lock held on the network's hosts during the whole run,
+// so that runs of different users don't overlap. It's a directory created
+// atomically by mkdir, with the owner of the lock written inside.
+type Lock struct {
+	Path string `yaml:"path"` // Lock directory, defaults to /tmp/sup.lock.
+	Host string `yaml:"host"` // Host holding the lock for the whole network, instead of each of the hosts.
+
+	disabled bool
+}
+
+func (l *Lock) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// lock: true
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		l.disabled = !enabled
+		return nil
+	}
+
+	// lock: /path/to/lock
+	if err := unmarshal(&l.Path); err == nil {
+		return nil
+	}
+
+	// Map with path and host.
+	type lock Lock
+	return unmarshal((*lock)(l))
+}
+
+// path returns the lock directory. $VARs are expanded on the host.
+func (l *Lock) path() string {
+	if l.Path == "" {
+		return "/tmp/sup.lock"
+	}
+	return l.Path
+}
+
+// ErrLocked is returned when the lock is held by another run.
+type ErrLocked struct {
+	Host  string
+	Owner string // user@hostname of the holder of the lock.
+	User  string // SUP_USER of the holder of the lock.
+	Since string // SUP_TIME of the holder of the lock.
+}
+
+func (e ErrLocked) Error() string {
+	if e.Owner == "" {
+		return fmt.Sprintf("%v: locked by another run", e.Host)
+	}
+	by := e.Owner
+	if e.User != "" {
+		by = e.User + " (" + e.Owner + ")"
+	}
+	return fmt.Sprintf("%v: locked by %v since %v, use --force-unlock to remove stale lock", e.Host, by, e.Since)
+}
+
+// lock acquires the network's lock and returns function releasing it.
+// The lock is acquired and released by the network's clients, before and
+// after the commands are run; only the lock host outside of the network
+// is connected separately. Interrupted run doesn't start any more commands,
+// so the lock is released once the running commands finish.
+func (r *runner) lock(l *Lock) (func(), error) {
+	clients, hosts := r.clients, r.network.Hosts
+	closeAll := func() {}
+	if l.Host != "" {
+		clients, hosts = nil, []string{l.Host}
+		for i, host := range r.network.Hosts {
+			if host == l.Host {
+				clients = r.clients[i : i+1]
+				break
+			}
+		}
+		if clients == nil {
+			c, err := r.dial(0, l.Host)
+			if err != nil {
+				return nil, errors.Wrap(err, "connecting to lock host failed")
+			}
+			clients = []Client{c}
+			closeAll = func() { c.Close() }
+		}
+	}
+
+	path := `"` + l.path() + `"`
+	id := fmt.Sprintf("%v-%v", os.Getpid(), time.Now().UnixNano())
+	owner := "unknown"
+	if u, err := user.Current(); err == nil {
+		owner = u.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		owner += "@" + hostname
+	}
+
+	if r.sup.forceUnlock {
+		err := forEach(clients, func(c Client) error {
+			return withOutput(runRemote(`rm -rf `+path, c))
+		})
+		if err != nil {
+			closeAll()
+			return nil, errors.Wrap(err, "removing lock failed")
+		}
+		fmt.Fprintf(os.Stderr, "lock %v removed\n", l.path())
+	}
+
+	// Create the lock directory or print the lock's owner.
+	acquire := `if mkdir ` + path + ` 2>/dev/null; then ` +
+		`printf 'id=%s\nowner=%s\nuser=%s\ntime=%s\n' ` + shellQuote(id) + ` ` + shellQuote(owner) + ` ` +
+		shellQuote(r.vars.value("SUP_USER")) + ` ` + shellQuote(r.vars.value("SUP_TIME")) + ` > ` + path + `/owner; ` +
+		`elif [ -d ` + path + ` ]; then cat ` + path + `/owner 2>/dev/null; exit 75; ` +
+		`else echo "can't create lock "` + path + ` >&2; exit 1; fi`
+	// Remove the lock directory, if it's still ours.
+	release := `grep -qx ` + shellQuote("id="+id) + ` ` + path + `/owner 2>/dev/null && rm -rf ` + path
+
+	var mu sync.Mutex
+	var locked []Client
+	errs := make([]error, len(clients))
+	forEachIndex(clients, func(i int, c Client) {
+		output, err := runRemote(acquire, c)
+		if err == nil {
+			mu.Lock()
+			locked = append(locked, c)
+			mu.Unlock()
+			return
+		}
+		if exitStatus(err) == 75 {
+			errs[i] = parseLockOwner(hosts[i], output)
+			return
+		}
+		errs[i] = withOutput(output, err)
+	})
+
+	unlock := func() {
+		err := forEach(locked, func(c Client) error {
+			return withOutput(runRemote(release, c))
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", errors.Wrap(err, "releasing lock failed"))
+		}
+		closeAll()
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			unlock()
+			if _, ok := err.(ErrLocked); ok {
+				return nil, err
+			}
+			return nil, errors.Wrapf(err, "%v: acquiring lock failed", hosts[i])
+		}
+	}
+
+	return unlock, nil
+}
+
+// parseLockOwner parses the lock's owner file.
+func parseLockOwner(host string, output []byte) ErrLocked {
+	e := ErrLocked{Host: host}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "owner":
+			e.Owner = kv[1]
+		case "user":
+			e.User = kv[1]
+		case "time":
+			e.Since = kv[1]
+		}
+	}
+	return e
+}
+
+// forEachIndex calls the function for each of the clients in parallel.
+func forEachIndex(clients []Client, fn func(int, Client)) {
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			fn(i, c)
+		}(i, c)
+	}
+	wg.Wait()
+}
+
+// forEach calls the function for each of the clients in parallel
+// and returns the first error.
+func forEach(clients []Client, fn func(Client) error) error {
+	errs := make([]error, len(clients))
+	forEachIndex(clients, func(i int, c Client) {
+		errs[i] = fn(c)
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Output modes, see Stackup.Output.
+const (
+	OutputStream  = "stream"  // Prefixed lines of all the hosts, as they come.
+	OutputGrouped = "grouped" // Output of each host as a block, once the host finishes.
+	OutputDiff    = "diff"    // Output of the hosts with identical output as a single block.
+
+	outputQuiet = "quiet" // Output of each failed host as a block, see Stackup.Quiet.
+)
+
+// blockMu keeps blocks of the concurrent commands from interleaving.
+var blockMu sync.Mutex
+
+// blocks buffers output of the task's clients to be printed as blocks,
+// see OutputGrouped and OutputDiff.
+type blocks struct {
+	r       *runner
+	cmd     *Command
+	mode    string
+	clients []Client
+	bufs    map[Client][]*bytes.Buffer // Buffers of the client's streams.
+	open    map[Client]int             // Number of the client's streams not finished yet.
+	mu      sync.Mutex
+}
+
+func (r *runner) newBlocks(cmd *Command, clients []Client, mode string) *blocks {
+	return &blocks{
+		r:       r,
+		cmd:     cmd,
+		mode:    mode,
+		clients: clients,
+		bufs:    map[Client][]*bytes.Buffer{},
+		open:    map[Client]int{},
+	}
+}
+
+// writer returns writer of the client's stream, ie. STDOUT or STDERR,
+// which must be closed once the stream is finished. Grouped streams
+// share the buffer to keep order of the lines, while diffed streams
+// are buffered separately, so that the order doesn't matter.
+func (b *blocks) writer(c Client) io.Writer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open[c]++
+	if len(b.bufs[c]) == 0 || b.mode == OutputDiff {
+		b.bufs[c] = append(b.bufs[c], &bytes.Buffer{})
+	}
+	return blockWriter{b, b.bufs[c][len(b.bufs[c])-1]}
+}
+
+type blockWriter struct {
+	b   *blocks
+	buf *bytes.Buffer
+}
+
+func (w blockWriter) Write(p []byte) (int, error) {
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// output returns the client's output, ie. content of all its streams.
+func (b *blocks) output(c Client) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []byte
+	for _, buf := range b.bufs[c] {
+		out = append(out, buf.Bytes()...)
+	}
+	return out
+}
+
+// close finishes the client's stream. Grouped output of the client
+// is printed, once all of its streams are finished.
+func (b *blocks) close(c Client) {
+	b.mu.Lock()
+	b.open[c]--
+	done := b.open[c] == 0
+	b.mu.Unlock()
+
+	if done && b.mode == OutputGrouped {
+		b.print([]Client{c}, b.output(c), nil)
+	}
+}
+
+// fail prints quiet output of the failed client, followed by the error.
+func (b *blocks) fail(c Client, err error) {
+	b.print([]Client{c}, b.output(c), err)
+}
+
+// flush prints the output of the hosts with identical output together,
+// in order of the hosts.
+func (b *blocks) flush() {
+	if b.mode != OutputDiff {
+		return
+	}
+
+	var groups [][]Client
+	byOutput := map[string]int{}
+	for _, c := range b.clients {
+		out := string(b.output(c))
+		i, ok := byOutput[out]
+		if !ok {
+			i = len(groups)
+			byOutput[out] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], c)
+	}
+	for _, group := range groups {
+		b.print(group, b.output(group[0]), nil)
+	}
+}
+
+// print prints the output of the clients as a block with a header,
+// and the error to STDERR. Hosts without any output are left out.
+func (b *blocks) print(clients []Client, out []byte, err error) {
+	if len(out) == 0 && err == nil {
+		return
+	}
+
+	var hosts []string
+	for _, c := range clients {
+		hosts = append(hosts, b.r.host(c))
+	}
+	header := fmt.Sprintf("%v (%v):", strings.Join(hosts, ", "), b.cmd.Name)
+	if i, ok := b.r.index(clients[0]); ok && b.r.sup.prefix {
+		header = Colors[i%len(Colors)] + header + ResetColor
+	}
+
+	blockMu.Lock()
+	defer blockMu.Unlock()
+	if b.r.progress != nil {
+		b.r.progress.clearLocked()
+	}
+	fmt.Fprintln(os.Stdout, header)
+	os.Stdout.Write(out)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		fmt.Fprintln(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v\n", b.r.prefix(clients[0]), err)
+	}
+}
@@ -0,0 +1,215 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progress displays counts of the hosts, which completed, are running
+// or failed each of the running commands, see Stackup.Quiet. On a terminal,
+// the lines are redrawn as the hosts progress; otherwise, a line is printed
+// once the command finishes.
+type progress struct {
+	w     io.Writer
+	tty   bool
+	cmds  []*cmdProgress // Running commands, in order of their start.
+	lines int            // Number of the lines drawn on the terminal.
+	stop  chan struct{}
+	done  chan struct{}
+	mu    sync.Mutex
+}
+
+// cmdProgress is progress of a command on the hosts, keyed by the command's
+// result on each host, since the network may list the same host more times.
+type cmdProgress struct {
+	name      string
+	running   map[*Result]time.Time     // Start of the command's task on the running hosts.
+	failed    map[*Result]bool          // Did the command fail on the finished hosts?
+	durations map[*Result]time.Duration // Duration of the command on the finished hosts.
+}
+
+// Number of the slowest hosts shown.
+const slowestHosts = 3
+
+// Interval of redrawing the progress on the terminal.
+const progressInterval = 200 * time.Millisecond
+
+func newProgress(w io.Writer, tty bool) *progress {
+	p := &progress{
+		w:    w,
+		tty:  tty,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *progress) loop() {
+	defer close(p.done)
+	if !p.tty {
+		<-p.stop
+		return
+	}
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.render()
+		case <-p.stop:
+			p.clear()
+			return
+		}
+	}
+}
+
+// Close stops redrawing the progress and clears it.
+func (p *progress) Close() error {
+	close(p.stop)
+	<-p.done
+	return nil
+}
+
+// cmd returns progress of the running command, creating it if needed.
+// Caller must hold p.mu.
+func (p *progress) cmd(name string) *cmdProgress {
+	for _, cp := range p.cmds {
+		if cp.name == name {
+			return cp
+		}
+	}
+	cp := &cmdProgress{
+		name:      name,
+		running:   map[*Result]time.Time{},
+		failed:    map[*Result]bool{},
+		durations: map[*Result]time.Duration{},
+	}
+	p.cmds = append(p.cmds, cp)
+	return cp
+}
+
+// start records start of the command on the result's host.
+func (p *progress) start(res *Result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cp := p.cmd(res.Command)
+	if _, ok := cp.running[res]; !ok {
+		cp.running[res] = time.Now()
+	}
+}
+
+// finish records the command as finished on the result's host.
+func (p *progress) finish(res *Result, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cp := p.cmd(res.Command)
+	start, ok := cp.running[res]
+	if !ok {
+		return
+	}
+	delete(cp.running, res)
+	cp.durations[res] += time.Since(start)
+	cp.failed[res] = cp.failed[res] || err != nil
+}
+
+// end prints the final progress of the command, which finished on all the hosts.
+func (p *progress) end(cmd string) {
+	blockMu.Lock()
+	defer blockMu.Unlock()
+	p.clearLocked()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, cp := range p.cmds {
+		if cp.name != cmd {
+			continue
+		}
+		p.cmds = append(p.cmds[:i], p.cmds[i+1:]...)
+		if len(cp.failed) > 0 {
+			fmt.Fprintln(p.w, cp.String())
+		}
+		return
+	}
+}
+
+// render redraws progress of the running commands.
+func (p *progress) render() {
+	blockMu.Lock()
+	defer blockMu.Unlock()
+	p.clearLocked()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, cp := range p.cmds {
+		fmt.Fprintf(p.w, "%v\n", cp)
+		p.lines++
+	}
+}
+
+// clear clears the lines drawn on the terminal.
+func (p *progress) clear() {
+	blockMu.Lock()
+	defer blockMu.Unlock()
+	p.clearLocked()
+}
+
+// clearLocked clears the lines drawn on the terminal. Caller must hold blockMu.
+func (p *progress) clearLocked() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.w, "\033[%dA\033[J", p.lines)
+		p.lines = 0
+	}
+}
+
+// String returns the counts of the hosts and the slowest hosts:
+// the running ones, or the finished ones, once no host is running.
+func (cp *cmdProgress) String() string {
+	type host struct {
+		name     string
+		duration time.Duration
+	}
+	var hosts []host
+	if len(cp.running) > 0 {
+		for res, start := range cp.running {
+			hosts = append(hosts, host{res.Host, time.Since(start)})
+		}
+	} else {
+		for res, d := range cp.durations {
+			hosts = append(hosts, host{res.Host, d})
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].duration > hosts[j].duration
+	})
+	if len(hosts) > slowestHosts {
+		hosts = hosts[:slowestHosts]
+	}
+
+	completed, failed := 0, 0
+	for res, f := range cp.failed {
+		if _, ok := cp.running[res]; ok {
+			continue // Running the next task.
+		}
+		if f {
+			failed++
+		} else {
+			completed++
+		}
+	}
+
+	line := fmt.Sprintf("%v: %v completed, %v running, %v failed", cp.name, completed, len(cp.running), failed)
+	if len(hosts) > 0 {
+		var slowest []string
+		for _, h := range hosts {
+			slowest = append(slowest, fmt.Sprintf("%v (%v)", h.name, h.duration.Round(100*time.Millisecond)))
+		}
+		line += ", slowest: " + strings.Join(slowest, ", ")
+	}
+	return line
+}
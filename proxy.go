@@ -0,0 +1,149 @@
+package sup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// serveProxy handles a single proxy connection. It speaks either SOCKS5
+// or HTTP proxy protocol (sniffed from the first byte) and dials
+// the requested address from localhost.
+func serveProxy(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+
+	if b[0] == 5 {
+		serveSocks(conn, r)
+	} else {
+		serveHTTPProxy(conn, r)
+	}
+}
+
+// serveSocks implements CONNECT command of SOCKS5 protocol without
+// authentication, see RFC 1928.
+func serveSocks(conn net.Conn, r *bufio.Reader) {
+	// Greeting: VER, NMETHODS, METHODS.
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(r, make([]byte, header[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil { // No authentication required.
+		return
+	}
+
+	// Request: VER, CMD, RSV, ATYP, DST.ADDR, DST.PORT.
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return
+	}
+	if req[1] != 1 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0}) // Command not supported.
+		return
+	}
+
+	var host string
+	switch req[3] {
+	case 1: // IPv4
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3: // Domain name
+		n, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		domain := make([]byte, n)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return
+		}
+		host = string(domain)
+	case 4: // IPv6
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0}) // Address type not supported.
+		return
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0}) // Host unreachable.
+		return
+	}
+	defer target.Close()
+
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	pipe(struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, target)
+}
+
+// serveHTTPProxy implements HTTP proxy, both CONNECT tunnels
+// and plain HTTP requests with absolute URLs.
+func serveHTTPProxy(conn net.Conn, r *bufio.Reader) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+
+	addr := req.Host
+	if req.Method != http.MethodConnect && req.URL.Host != "" {
+		addr = req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n%v\n", err)
+		return
+	}
+	defer target.Close()
+
+	if req.Method == http.MethodConnect {
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return
+		}
+		pipe(struct {
+			io.Reader
+			io.Writer
+		}{r, conn}, target)
+		return
+	}
+
+	// One request per connection, so we don't need to parse the responses.
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	if err := req.Write(target); err != nil {
+		return
+	}
+	io.Copy(conn, target)
+}
@@ -0,0 +1,68 @@
+package sup
+
+import (
+	"regexp"
+	"strings"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// registered are env vars captured from outputs of the commands,
+// see Command.Register.
+type registered struct {
+	global EnvList         // Vars of "once" and local commands, shared by all the hosts.
+	hosts  map[int]EnvList // Vars of each host, by index of the host.
+}
+
+// register stores the command's output as an env var of the client.
+// Outputs of "once" and local commands are broadcast to all the clients.
+func (r *runner) register(cmd *Command, c Client, output string) {
+	value := strings.TrimSpace(strings.Replace(output, "\r\n", "\n", -1))
+	index, ok := r.index(c)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.registered.hosts == nil {
+		r.registered.hosts = map[int]EnvList{}
+	}
+
+	if cmd.Once || !ok {
+		r.registered.global.Set(cmd.Register, value)
+		for i := range r.clients {
+			vars := r.registered.hosts[i]
+			vars.Set(cmd.Register, value)
+			r.registered.hosts[i] = vars
+		}
+		return
+	}
+
+	vars := r.registered.hosts[index]
+	vars.Set(cmd.Register, value)
+	r.registered.hosts[index] = vars
+}
+
+// withVars returns copy of the task exporting the client's registered env vars.
+func (r *runner) withVars(task *Task, c Client) *Task {
+	index, isHost := r.index(c)
+
+	r.mu.Lock()
+	vars, ok := r.registered.hosts[index]
+	if !ok || !isHost {
+		vars = r.registered.global
+	}
+
+	// Registered values are exported literally, no $VAR expansion.
+	exports := ""
+	for _, v := range vars {
+		exports += `export ` + v.Key + `=` + shellQuote(v.Value) + `; `
+	}
+	r.mu.Unlock()
+	if exports == "" {
+		return task
+	}
+
+	t := *task
+	t.Run = exports + t.Run
+	return &t
+}
@@ -0,0 +1,170 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Release deploys a new release directory and atomically switches
+// the "current" symlink to it:
+//
+//	DIR/releases/20161120161129/ - Releases, named by $SUP_TIME.
+//	DIR/shared/                  - Files shared by all the releases.
+//	DIR/current                  - Symlink to the current release.
+//
+// The command's "run" is run inside of the new release before the switch.
+type Release struct {
+	Dir    string   `yaml:"dir"`     // Base directory on the hosts.
+	Src    string   `yaml:"src"`     // Local directory uploaded to the new release.
+	Exc    string   `yaml:"exclude"` // Patterns excluded from the upload.
+	Shared []string `yaml:"shared"`  // Paths linked from the shared dir into the new release.
+	Keep   int      `yaml:"keep"`    // Number of releases to be kept, defaults to 5.
+}
+
+func (r *Release) validate(cmd *Command) error {
+	if !path.IsAbs(r.Dir) {
+		return errors.New("release: dir must be an absolute path")
+	}
+	if r.Keep < 0 {
+		return errors.New("release: keep must be a positive number")
+	}
+	for _, p := range r.Shared {
+		if path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "..") {
+			return fmt.Errorf("release: shared path %v must be relative to the release", p)
+		}
+	}
+	if cmd.Local != "" || cmd.Script != "" || len(cmd.Upload) > 0 {
+		return errors.New("release can't be combined with local, script or upload")
+	}
+	return nil
+}
+
+// vars returns shell snippet setting $D to the base dir and $R to name
+// of the release, ie. $SUP_TIME without the separators.
+func (r *Release) vars() string {
+	return `D="` + strings.TrimRight(r.Dir, "/") + `"; R=$(echo "$SUP_TIME" | tr -dc 0-9); `
+}
+
+// switchCurrent is shell snippet atomically pointing the current
+// symlink to the release $1.
+const switchCurrent = `ln -sfn "releases/$1" "$D/.current.$$" && ` +
+	`{ mv -T "$D/.current.$$" "$D/current" 2>/dev/null || mv -fh "$D/.current.$$" "$D/current"; }`
+
+// rollbackScript returns shell snippet pointing the current symlink to
+// the release, which was current before the current one was released,
+// or to the release preceding the current one.
+func (r *Release) rollbackScript() string {
+	return r.vars() + `cur=$(basename "$(readlink "$D/current")"); ` +
+		`prev=$(cat "$D/releases/.$cur.previous" 2>/dev/null); ` +
+		`if [ -z "$prev" ] || [ ! -d "$D/releases/$prev" ]; then ` +
+		`prev=$(ls -1 "$D/releases" | sort | awk -v cur="$cur" '$0 < cur' | tail -n 1); fi; ` +
+		`if [ -z "$prev" ]; then echo "$D: no release before $cur" >&2; exit 1; fi; ` +
+		`set -- "$prev"; ` + switchCurrent + ` && echo "$D: rolled back from $cur to $prev"`
+}
+
+// releaseTasks translates the release command into tasks.
+func (sup *Stackup) releaseTasks(cmd *Command, clients []Client, env string) ([]*Task, error) {
+	r := cmd.Release
+	var steps []taskStep
+
+	// Create the release dir.
+	prepare := Task{
+		Run: r.vars() + `mkdir -p "$D/releases/$R" "$D/shared"`,
+	}
+	steps = append(steps, func() (Task, error) { return prepare, nil })
+
+	// Upload content of the source dir.
+	if r.Src != "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, errors.Wrap(err, "resolving CWD failed")
+		}
+		src, err := ResolveLocalPath(cwd, r.Src, env)
+		if err != nil {
+			return nil, errors.Wrap(err, "release: "+r.Src)
+		}
+		// The tar stream is read once, so each batch gets its own.
+		steps = append(steps, func() (Task, error) {
+			tar, err := NewTarStreamReader(src, ".", r.Exc)
+			if err != nil {
+				return Task{}, errors.Wrap(err, "release: "+r.Src)
+			}
+			return Task{
+				Run:   r.vars() + `tar -C "$D/releases/$R" -xzf -`,
+				Input: tar,
+			}, nil
+		})
+	}
+
+	// Link the shared paths, run the command in the release, switch
+	// the current symlink and prune the old releases, except for
+	// the previous current one.
+	run := r.vars() + `cd "$D/releases/$R" || exit 1; `
+	for _, p := range r.Shared {
+		p = path.Clean(p)
+		run += fmt.Sprintf(`rm -rf "./%[1]v" && mkdir -p "$(dirname "./%[1]v")" "$(dirname "$D/shared/%[1]v")" && ln -s "$D/shared/%[1]v" "./%[1]v" || exit 1; `, p)
+	}
+	if cmd.Run != "" {
+		run += `(` + cmd.Run + "\n) || exit $?; "
+	}
+	keep := r.Keep
+	if keep == 0 {
+		keep = 5
+	}
+	run += `prev=$(basename "$(readlink "$D/current")" 2>/dev/null); ` +
+		`if [ -n "$prev" ] && [ "$prev" != "$R" ]; then echo "$prev" > "$D/releases/.$R.previous"; fi; ` +
+		`set -- "$R"; ` + switchCurrent + ` || exit 1; ` +
+		fmt.Sprintf(`ls -1 "$D/releases" | sort -r | tail -n +%v | while read old; do `, keep+1) +
+		`[ "$old" = "$R" ] || [ "$old" = "$prev" ] || rm -rf "$D/releases/$old" "$D/releases/.$old.previous"; done; ` +
+		`echo "$D: released $R"`
+
+	task := Task{
+		Run: run,
+		TTY: true,
+	}
+	if sup.debug {
+		task.Run = "set -x;" + task.Run
+	}
+	if cmd.Stdin {
+		task.Input = os.Stdin
+	}
+	steps = append(steps, func() (Task, error) { return task, nil })
+
+	return batchTasks(cmd, clients, steps)
+}
+
+// ReleaseRollback returns command pointing the current symlink of all
+// the releases back to the previous release on all the hosts.
+func (s *Supfile) ReleaseRollback() (*Command, error) {
+	dirs := map[string]*Release{}
+	for _, cmd := range s.Commands.cmds {
+		if cmd.Release != nil {
+			dirs[cmd.Release.Dir] = cmd.Release
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("rollback: no release commands in Supfile")
+	}
+
+	var names []string
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+
+	var scripts []string
+	for _, dir := range names {
+		scripts = append(scripts, "("+dirs[dir].rollbackScript()+")")
+	}
+
+	return &Command{
+		Name: "rollback",
+		Desc: "Switch to the previous release",
+		Run:  strings.Join(scripts, " && "),
+	}, nil
+}
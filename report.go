@@ -0,0 +1,358 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Result is the outcome of a command on a host.
+type Result struct {
+	Host       string        `json:"host"`
+	HostIndex  int           `json:"host_index"` // Index of the host in the network, or -1 for the local commands.
+	Command    string        `json:"command"`
+	Status     string        `json:"status"` // "ok", "failed", "interrupted" or "skipped".
+	ExitStatus int           `json:"exit_status"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration_ns"`
+	Log        string        `json:"log,omitempty"`    // Path of the log file, see Stackup.LogDir.
+	Stderr     []string      `json:"stderr,omitempty"` // Last lines of the failed command's STDERR, or output if run in pseudo terminal.
+
+	log  *logFile
+	tail *tailWriter
+}
+
+// Result statuses.
+const (
+	StatusOK          = "ok"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted" // Failed after a signal was forwarded to the task.
+	StatusSkipped     = "skipped"
+)
+
+// Report is the outcome of Stackup.Run.
+type Report struct {
+	Results  []*Result     // Results of the commands on the hosts, in order of their start.
+	Duration time.Duration // Duration of the whole run.
+}
+
+// HostSummary sums up results of all the commands on a host.
+type HostSummary struct {
+	Host        string
+	HostIndex   int // Index of the host in the network, or -1 for the local commands.
+	OK          int
+	Failed      int  // Number of the failed commands, including the interrupted ones.
+	Interrupted bool // Was a command interrupted on the host?
+	Skipped     int
+	ExitStatus  int           // Exit status of the first failed command.
+	Duration    time.Duration // Total duration of the commands.
+	Stderr      []string      // Last lines of the first failed command's STDERR, see Result.Stderr.
+}
+
+// Hosts returns summary of each host, in order of the first result.
+// The local commands are summed up as a host of index -1.
+func (rep *Report) Hosts() []*HostSummary {
+	var hosts []*HostSummary
+	byHost := map[int]*HostSummary{}
+	for _, res := range rep.Results {
+		h, ok := byHost[res.HostIndex]
+		if !ok {
+			h = &HostSummary{Host: res.Host, HostIndex: res.HostIndex}
+			byHost[res.HostIndex] = h
+			hosts = append(hosts, h)
+		}
+		switch res.Status {
+		case StatusOK:
+			h.OK++
+		case StatusFailed, StatusInterrupted:
+			h.Interrupted = h.Interrupted || res.Status == StatusInterrupted
+			if h.Failed == 0 {
+				h.ExitStatus = res.ExitStatus
+				h.Stderr = res.Stderr
+			}
+			h.Failed++
+		case StatusSkipped:
+			h.Skipped++
+		}
+		h.Duration += res.Duration
+	}
+	return hosts
+}
+
+// report collects results of the commands on all the hosts.
+type report struct {
+	mu      sync.Mutex
+	results []*Result
+	byKey   map[resultKey]*Result
+}
+
+// resultKey identifies result by the host's index, since the network
+// may list the same host more times.
+type resultKey struct {
+	host int
+	cmd  string
+}
+
+// result returns result of the command on the client's host, creating it
+// if needed. Caller must hold r.report.mu.
+func (r *runner) result(c Client, cmd string) *Result {
+	i, ok := r.index(c)
+	if !ok {
+		i = -1 // Local command.
+	}
+	rep := &r.report
+	key := resultKey{i, cmd}
+	if res, ok := rep.byKey[key]; ok {
+		return res
+	}
+	if rep.byKey == nil {
+		rep.byKey = map[resultKey]*Result{}
+	}
+	res := &Result{Host: r.host(c), HostIndex: i, Command: cmd}
+	rep.byKey[key] = res
+	rep.results = append(rep.results, res)
+	return res
+}
+
+// begin starts the command's task on the client. It returns writer
+// of the client's log file, or nil if the output isn't logged,
+// and writer keeping the last lines of the client's STDERR
+// (or the whole output, if the task is run in pseudo terminal).
+func (r *runner) begin(cmd *Command, c Client) (log io.Writer, stderr io.Writer) {
+	r.report.mu.Lock()
+	defer r.report.mu.Unlock()
+
+	res := r.result(c, cmd.Name)
+	if res.Start.IsZero() {
+		res.Start = time.Now()
+	}
+	if res.Status == "" || res.Status == StatusSkipped {
+		res.Status = StatusOK
+	}
+	if res.tail == nil {
+		res.tail = &tailWriter{}
+	}
+	if r.progress != nil {
+		r.progress.start(res)
+	}
+
+	if r.sup.logDir == "" {
+		return nil, res.tail
+	}
+	if res.log == nil {
+		path := filepath.Join(r.logDir(), r.logHost(res), pathName(res.Command)+".log")
+		log, err := openLog(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return nil, res.tail
+		}
+		res.Log = path
+		res.log = log
+	}
+	res.log.refs++
+	return res.log, res.tail
+}
+
+// finish completes the command's task on the client.
+func (r *runner) finish(cmd *Command, c Client, err error) {
+	r.report.mu.Lock()
+	defer r.report.mu.Unlock()
+
+	res := r.result(c, cmd.Name)
+	res.Duration = time.Since(res.Start)
+	if r.progress != nil {
+		r.progress.finish(res, err)
+	}
+	if err != nil {
+		res.Status = StatusFailed
+		if r.signaled(c) {
+			res.Status = StatusInterrupted
+		}
+		res.ExitStatus = exitStatus(err)
+		if res.tail != nil {
+			res.Stderr = res.tail.lines()
+		}
+	}
+	if res.log != nil {
+		res.log.refs--
+		if res.log.refs == 0 {
+			res.log.Close()
+			res.log = nil
+		}
+	}
+}
+
+// skip records the command as skipped on the client.
+func (r *runner) skip(cmd *Command, c Client) {
+	r.report.mu.Lock()
+	defer r.report.mu.Unlock()
+
+	res := r.result(c, cmd.Name)
+	if res.Status == "" {
+		res.Status = StatusSkipped
+	}
+}
+
+// logHost returns name of the result's host directory in the log dir.
+// Host listed more times by the network gets a directory for each listing,
+// ie. <host>-<index>.
+func (r *runner) logHost(res *Result) string {
+	name := pathName(res.Host)
+	for i, host := range r.network.Hosts {
+		if host == res.Host && i != res.HostIndex && res.HostIndex >= 0 {
+			return fmt.Sprintf("%v-%v", name, res.HostIndex)
+		}
+	}
+	return name
+}
+
+// logDir returns directory of the run's logs, ie. DIR/<run-id>.
+// Resumed runs share the directory, since they share $SUP_TIME.
+func (r *runner) logDir() string {
+	id := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, r.vars.value("SUP_TIME"))
+	if network := r.vars.value("SUP_NETWORK"); network != "" {
+		id += "-" + network
+	}
+	return filepath.Join(r.sup.logDir, pathName(id))
+}
+
+// snapshot returns report of the results so far.
+func (r *runner) snapshot(start time.Time) *Report {
+	r.report.mu.Lock()
+	defer r.report.mu.Unlock()
+
+	rep := &Report{Duration: time.Since(start)}
+	for _, res := range r.report.results {
+		copy := *res
+		copy.log, copy.tail = nil, nil
+		rep.Results = append(rep.Results, &copy)
+	}
+	return rep
+}
+
+// summary is the content of the summary.json file.
+type summary struct {
+	Network  string        `json:"network"`
+	Time     string        `json:"sup_time"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+	Results  []*Result     `json:"results"`
+}
+
+// writeSummary writes summary.json with results of the run to the log dir.
+func (r *runner) writeSummary(rep *Report, runErr error) error {
+	s := summary{
+		Network:  r.vars.value("SUP_NETWORK"),
+		Time:     r.vars.value("SUP_TIME"),
+		Duration: rep.Duration,
+		Results:  rep.Results,
+	}
+	if runErr != nil {
+		s.Error = runErr.Error()
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := r.logDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "writing summary failed")
+	}
+	return errors.Wrap(ioutil.WriteFile(filepath.Join(dir, "summary.json"), append(data, '\n'), 0644), "writing summary failed")
+}
+
+// logFile is a log file written by the client's STDOUT and STDERR.
+type logFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	refs int // Number of the running tasks writing the file.
+}
+
+func openLog(path string) (*logFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrap(err, "creating log dir failed")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening log file failed")
+	}
+	return &logFile{f: f}, nil
+}
+
+// Write never fails, so that failed logging doesn't break the output.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f.Write(p)
+	return len(p), nil
+}
+
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// tailWriter keeps the last lines written.
+type tailWriter struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// Number of the kept lines.
+const tailLines = 3
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+
+	// Drop the lines not needed anymore, but keep the unfinished one.
+	for n := bytes.Count(t.buf, []byte("\n")); n > tailLines; n-- {
+		t.buf = t.buf[bytes.IndexByte(t.buf, '\n')+1:]
+	}
+	return len(p), nil
+}
+
+// lines returns the last non-empty lines.
+func (t *tailWriter) lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var lines []string
+	for _, line := range strings.Split(string(t.buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > tailLines {
+		lines = lines[len(lines)-tailLines:]
+	}
+	return lines
+}
+
+// pathName returns the name usable as a file name.
+func pathName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', 0:
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,142 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// step is a command completed on a set of clients.
+type step struct {
+	cmd     *Command
+	clients []Client
+}
+
+// complete records the command as completed on the clients.
+func (r *runner) complete(cmd *Command, clients []Client) {
+	if len(clients) == 0 {
+		return
+	}
+	r.mu.Lock()
+	r.journal = append(r.journal, step{cmd, clients})
+	r.mu.Unlock()
+
+	r.saveProgress(cmd, clients)
+}
+
+// ErrRollback is returned when a failed run was rolled back.
+type ErrRollback struct {
+	Err      error // The original error.
+	Rollback error // Error of the rollback, if it failed too.
+}
+
+func (e ErrRollback) Error() string {
+	if e.Rollback != nil {
+		return fmt.Sprintf("%v\nrollback failed: %v", e.Err, e.Rollback)
+	}
+	return fmt.Sprintf("%v\nrollback succeeded", e.Err)
+}
+
+// Cause returns the original error, see errors.Cause().
+func (e ErrRollback) Cause() error {
+	return e.Err
+}
+
+// rollback runs "rollback" snippets of the completed commands in reverse order,
+// each on the hosts that completed the command. Then, it runs "on_failure" target
+// of the failed command's innermost target having one, on the hosts that ran any
+// of the target's commands. It returns the original error, if there is nothing
+// to roll back.
+func (r *runner) rollback(failedCmd *Command, err error) error {
+	journal := r.journal
+	failed := r.failed
+
+	var target string
+	var onFailure []*Command
+	if r.sup.conf != nil {
+		targets := failedCmd.parents
+		if len(targets) == 0 && failedCmd.Target != "" {
+			targets = []string{failedCmd.Target}
+		}
+		for i := len(targets) - 1; i >= 0 && target == ""; i-- {
+			t, _ := r.sup.conf.Targets.Get(targets[i])
+			if t.OnFailure != "" {
+				target = targets[i]
+				onFailure, _ = r.sup.conf.Resolve(t.OnFailure) // Validated by NewSupfile.
+			}
+		}
+	}
+	hasOnFailure := target != ""
+
+	var steps []step
+	for i := len(journal) - 1; i >= 0; i-- {
+		if journal[i].cmd.Rollback != "" {
+			steps = append(steps, journal[i])
+		}
+	}
+	if len(steps) == 0 && !hasOnFailure {
+		return err
+	}
+
+	// Interrupted run isn't rolled back, the hosts are left as they are.
+	if r.interrupted() != nil {
+		fmt.Fprintln(os.Stderr, "interrupted, not rolling back the failed run")
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "rolling back the failed run")
+	r.undoing = true
+
+	for _, s := range steps {
+		rollback := &Command{Name: s.cmd.Name + " (rollback)"}
+		if s.cmd.Local != "" && s.cmd.Run == "" && s.cmd.Script == "" && len(s.cmd.Upload) == 0 {
+			rollback.Local = s.cmd.Rollback
+		} else {
+			rollback.Run = s.cmd.Rollback
+		}
+
+		fmt.Fprintf(os.Stderr, "%v: rolling back on %v host(s)\n", s.cmd.Name, len(s.clients))
+		if rbErr := r.runCommand(rollback, s.clients); rbErr != nil {
+			return ErrRollback{err, errors.Wrap(rbErr, rollback.Name)}
+		}
+		r.undoProgress(s.cmd, s.clients)
+	}
+
+	if hasOnFailure {
+		// Hosts that ran any of the target's commands, or failed on them.
+		touched := map[int]bool{}
+		for _, s := range journal {
+			if s.cmd.inTarget(target) {
+				for _, c := range s.clients {
+					if i, ok := r.index(c); ok {
+						touched[i] = true
+					}
+				}
+			}
+		}
+		for _, c := range failed {
+			if i, ok := r.index(c); ok {
+				touched[i] = true
+			}
+		}
+		var clients []Client
+		for i, c := range r.clients {
+			if touched[i] {
+				clients = append(clients, c)
+			}
+		}
+
+		t, _ := r.sup.conf.Targets.Get(target)
+		fmt.Fprintf(os.Stderr, "%v: running on_failure target %v on %v host(s)\n", target, t.OnFailure, len(clients))
+		if len(clients) > 0 {
+			for _, cmd := range onFailure {
+				if rbErr := r.runCommand(cmd, clients); rbErr != nil {
+					return ErrRollback{err, errors.Wrap(rbErr, t.OnFailure)}
+				}
+			}
+		}
+	}
+
+	return ErrRollback{Err: err}
+}
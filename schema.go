@@ -0,0 +1,178 @@
+package sup
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// LatestVersion is the latest version of the Supfile format.
+const LatestVersion = "0.5"
+
+// SupfileVersions are the supported versions of the Supfile format.
+var SupfileVersions = []string{"0.1", "0.2", "0.3", "0.4", "0.5"}
+
+// Schema returns JSON Schema of the Supfile of the given version, so that
+// editors can complete and validate Supfiles. Keys rejected by NewSupfile
+// in the given version are left out, see keyVersions.
+func Schema(version string) ([]byte, error) {
+	supported := false
+	for _, v := range SupfileVersions {
+		supported = supported || v == version
+	}
+	if !supported {
+		return nil, ErrUnsupportedSupfileVersion{"unsupported Supfile version " + version}
+	}
+
+	g := &schemaGen{version: version, defs: map[string]interface{}{}}
+	schema := g.object(reflect.TypeOf(Supfile{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "Supfile v" + version
+	schema["definitions"] = g.defs
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// schemaGen generates JSON Schema of the Supfile's types.
+type schemaGen struct {
+	version string
+	defs    map[string]interface{} // Schemas of the named types.
+}
+
+// keyVersions are versions of the Supfile introducing the keys of the types,
+// as enforced by NewSupfile. Keys not listed are supported by all the versions.
+var keyVersions = map[reflect.Type]map[string]string{
+	reflect.TypeOf(Network{}): {
+		"inventory": "0.3",
+	},
+	reflect.TypeOf(Command{}): {
+		"run_once": "0.2",
+		"once":     "0.3",
+		"local":    "0.3",
+		"serial":   "0.3",
+	},
+}
+
+// since reports whether the schema's version supports the feature
+// introduced by the version.
+func (g *schemaGen) since(version string) bool {
+	return g.version >= version
+}
+
+// skip reports whether the schema's version doesn't support the struct's field.
+func (g *schemaGen) skip(t reflect.Type, key string) bool {
+	if t == reflect.TypeOf(Command{}) && key == "run_once" && g.since("0.4") {
+		return true // Deprecated by once in v0.3.
+	}
+	version, ok := keyVersions[t][key]
+	return ok && !g.since(version)
+}
+
+// ref returns reference to the definition of the named type.
+func (g *schemaGen) ref(t reflect.Type, schema func() map[string]interface{}) map[string]interface{} {
+	name := t.Name()
+	if _, ok := g.defs[name]; !ok {
+		g.defs[name] = nil // Placeholder, in case the type refers to itself.
+		g.defs[name] = schema()
+	}
+	return map[string]interface{}{"$ref": "#/definitions/" + name}
+}
+
+// scalar is schema of the YAML scalars, which are read as strings.
+var scalar = map[string]interface{}{"type": []string{"string", "number", "boolean"}}
+
+// typeSchema returns schema of the type, as it's read from YAML.
+func (g *schemaGen) typeSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case networksType, commandsType, targetsType:
+		elem := map[reflect.Type]reflect.Type{
+			networksType: reflect.TypeOf(Network{}),
+			commandsType: reflect.TypeOf(Command{}),
+			targetsType:  targetType,
+		}[t]
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": g.typeSchema(elem),
+		}
+
+	case envListType:
+		return g.ref(t, func() map[string]interface{} {
+			return map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": scalar,
+			}
+		})
+
+	case serialType:
+		return g.ref(t, func() map[string]interface{} {
+			size := map[string]interface{}{
+				"type":    []string{"integer", "string"},
+				"pattern": `^[0-9]+(\.[0-9]+)?%?$`,
+			}
+			return map[string]interface{}{
+				"description": `Batch size (2), percentage of hosts ("25%") or list of batch sizes`,
+				"anyOf": []interface{}{
+					size,
+					map[string]interface{}{"type": "array", "items": size},
+				},
+			}
+		})
+
+	case targetType:
+		return g.ref(t, func() map[string]interface{} {
+			return map[string]interface{}{
+				"oneOf": []interface{}{
+					map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+					g.object(t),
+				},
+			}
+		})
+
+	case lockType:
+		return g.ref(t, func() map[string]interface{} {
+			return map[string]interface{}{
+				"oneOf": []interface{}{
+					map[string]interface{}{"type": "boolean"},
+					map[string]interface{}{"type": "string"},
+					g.object(t),
+				},
+			}
+		})
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return g.ref(t, func() map[string]interface{} {
+			return g.object(t)
+		})
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": g.typeSchema(t.Elem()),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	default:
+		return scalar
+	}
+}
+
+// object returns schema of the struct's fields.
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	for key, field := range yamlFields(t) {
+		if g.skip(t, key) {
+			continue
+		}
+		props[key] = g.typeSchema(field)
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
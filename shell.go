@@ -0,0 +1,83 @@
+package sup
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Shell opens interactive login shell on the host of the network, connected
+// the same way and with the same env vars as the commands run by Stackup.Run.
+func (sup *Stackup) Shell(network *Network, envVars EnvList, host string) error {
+	env := envVars.AsExport() + `export SUP_HOST="` + host + `";`
+
+	var dialer SSHDialFunc
+	if network.Bastion != "" {
+		bastion := &SSHClient{}
+		if err := bastion.Connect(network.Bastion); err != nil {
+			return errors.Wrap(err, "connecting to bastion failed")
+		}
+		defer bastion.Close()
+		dialer = bastion.DialThrough
+	}
+
+	client, err := NewClient(host, ClientOptions{
+		Env:    env,
+		User:   network.User,
+		Color:  Colors[0],
+		Dialer: dialer,
+	})
+	if err != nil {
+		return err
+	}
+	if err := client.Connect(host); err != nil {
+		if dialer != nil {
+			return errors.Wrap(err, "connecting to remote host through bastion failed")
+		}
+		return errors.Wrap(err, "connecting to remote host failed")
+	}
+	defer client.Close()
+
+	task := &Task{
+		Run:     `exec "${SHELL:-sh}" -l`,
+		Input:   os.Stdin,
+		Clients: []Client{client},
+		TTY:     true,
+		Batches: 1,
+	}
+	if err := client.Run(task); err != nil {
+		return errors.Wrap(err, host)
+	}
+
+	// Pass all the keys over to the remote terminal.
+	if interactive(task) && withPty(task.Clients) {
+		restore, err := rawTerminal()
+		if err == nil {
+			defer restore()
+		}
+	}
+
+	go func() {
+		io.Copy(client.Stdin(), os.Stdin)
+		client.Stdin().Close()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(os.Stdout, client.Stdout())
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(os.Stderr, client.Stderr())
+	}()
+	wg.Wait()
+
+	if err := client.Wait(); err != nil {
+		return ErrTaskFailed{Failed: 1, ExitStatus: exitStatus(err)}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// forwardedSignals are passed over to the running tasks.
+var forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// signals is state of the signals forwarded to the running tasks.
+type signals struct {
+	running    map[Client]bool // Clients running a task.
+	signaled   map[Client]bool // Clients running a task, which was sent a signal.
+	killed     map[Client]bool // Clients, whose task was killed, to be closed once it exits.
+	interrupts int             // Number of the interrupts, ie. Ctrl-C presses.
+}
+
+// trap forwards the signals to the running tasks for the whole run. Any of
+// them stops the run from starting more commands. The second interrupt
+// kills the running tasks right away, without waiting for their commands
+// to exit, and closes their clients; the third one exits right away.
+// It returns function stopping the forwarding.
+func (r *runner) trap() (stop func()) {
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, forwardedSignals...)
+	go func() {
+		for sig := range trap {
+			r.signal(sig)
+		}
+	}()
+	return func() {
+		signal.Stop(trap)
+		close(trap)
+	}
+}
+
+// signal forwards the signal to the running tasks.
+func (r *runner) signal(sig os.Signal) {
+	r.interrupt()
+
+	r.mu.Lock()
+	if sig == os.Interrupt {
+		r.signals.interrupts++
+	}
+	interrupts := r.signals.interrupts
+	var clients []Client
+	for c := range r.signals.running {
+		clients = append(clients, c)
+		r.signals.signaled[c] = true
+		if interrupts == 2 && sig == os.Interrupt {
+			r.signals.killed[c] = true
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return r.hosts[clients[i]] < r.hosts[clients[j]]
+	})
+	r.mu.Unlock()
+
+	var hosts []string
+	for _, c := range clients {
+		hosts = append(hosts, r.host(c))
+	}
+
+	switch {
+	case interrupts >= 3:
+		fmt.Fprintf(os.Stderr, "\ninterrupted %v times, exiting\n", interrupts)
+		os.Exit(130)
+
+	case interrupts == 2 && sig == os.Interrupt:
+		fmt.Fprintf(os.Stderr, "\ninterrupt: killing tasks on %v host(s): %v (press Ctrl-C again to exit)\n", len(hosts), strings.Join(hosts, ", "))
+		for _, c := range clients {
+			kill(c)
+		}
+
+	default:
+		if len(clients) == 0 {
+			fmt.Fprintf(os.Stderr, "\n%v: not starting any more commands\n", sig)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "\n%v: signaling %v host(s): %v", sig, len(hosts), strings.Join(hosts, ", "))
+		if sig == os.Interrupt {
+			fmt.Fprintf(os.Stderr, " (press Ctrl-C again to kill the tasks)")
+		}
+		fmt.Fprintln(os.Stderr)
+		for i, c := range clients {
+			if err := c.Signal(sig); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", errors.Wrap(err, hosts[i]+": sending signal failed"))
+			}
+		}
+	}
+}
+
+// running records the client as running a task.
+func (r *runner) running(c Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.signals.running == nil {
+		r.signals.running = map[Client]bool{}
+		r.signals.signaled = map[Client]bool{}
+		r.signals.killed = map[Client]bool{}
+	}
+	r.signals.running[c] = true
+}
+
+// exited records the client's task as exited. It reports whether
+// the task was killed, so the client is to be closed.
+func (r *runner) exited(c Client) (killed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	killed = r.signals.killed[c]
+	delete(r.signals.running, c)
+	delete(r.signals.signaled, c)
+	delete(r.signals.killed, c)
+	return killed
+}
+
+// killed reports whether the client's running task was killed,
+// so its output may fail to be read.
+func (r *runner) killed(c Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.signals.killed[c]
+}
+
+// signaled reports whether the client's running task was sent a signal.
+func (r *runner) signaled(c Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.signals.signaled[c]
+}
@@ -10,7 +10,9 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
@@ -27,8 +29,11 @@ type SSHClient struct {
 	connOpened   bool
 	sessOpened   bool
 	running      bool
+	stopResize   func() // Stops syncing size of the session's pseudo terminal.
+	shared       bool   // Is the connection owned by another client? See fork.
 	env          string //export FOO="bar"; export BAR="baz";
 	color        string
+	dialer       SSHDialFunc
 }
 
 type ErrConnect struct {
@@ -117,6 +122,9 @@ type SSHDialFunc func(net, addr string, config *ssh.ClientConfig) (*ssh.Client,
 // Connect creates SSH connection to a specified host.
 // It expects the host of the form "[ssh://]host[:port]".
 func (c *SSHClient) Connect(host string) error {
+	if c.dialer != nil {
+		return c.ConnectWith(host, c.dialer)
+	}
 	return c.ConnectWith(host, ssh.Dial)
 }
 
@@ -181,15 +189,11 @@ func (c *SSHClient) Run(task *Task) error {
 		return err
 	}
 
-	if task.TTY {
-		// Set up terminal modes
-		modes := ssh.TerminalModes{
-			ssh.ECHO:          0,     // disable echoing
-			ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-			ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
-		}
-		// Request pseudo terminal
-		if err := sess.RequestPty("xterm", 80, 40, modes); err != nil {
+	// Request pseudo terminal, unless the output goes to a file or a pipe,
+	// which would get mangled by the terminal's CRLF line endings.
+	if task.TTY && isTerminal(os.Stdout) {
+		c.stopResize, err = requestPty(sess, interactive(task))
+		if err != nil {
 			return ErrTask{task, fmt.Sprintf("request for pseudo terminal failed: %s", err)}
 		}
 	}
@@ -214,12 +218,32 @@ func (c *SSHClient) Wait() error {
 
 	err := c.sess.Wait()
 	c.sess.Close()
+	if c.stopResize != nil {
+		c.stopResize()
+		c.stopResize = nil
+	}
 	c.running = false
 	c.sessOpened = false
 
 	return err
 }
 
+// execute runs a one-off command in a new session, independently
+// of the currently running task, and returns its combined output.
+func (c *SSHClient) execute(cmd string) ([]byte, error) {
+	if !c.connOpened {
+		return nil, fmt.Errorf("not connected to %v", c.host)
+	}
+
+	sess, err := c.conn.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "opening session failed")
+	}
+	defer sess.Close()
+
+	return sess.CombinedOutput(cmd)
+}
+
 // DialThrough will create a new connection from the ssh server sc is connected to. DialThrough is an SSHDialer.
 func (sc *SSHClient) DialThrough(net, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
 	conn, err := sc.conn.Dial(net, addr)
@@ -235,14 +259,24 @@ func (sc *SSHClient) DialThrough(net, addr string, config *ssh.ClientConfig) (*s
 }
 
 // Close closes the underlying SSH connection and session.
+// Forked clients close their session only.
 func (c *SSHClient) Close() error {
 	if c.sessOpened {
 		c.sess.Close()
 		c.sessOpened = false
 	}
+	if c.stopResize != nil {
+		c.stopResize()
+		c.stopResize = nil
+	}
 	if !c.connOpened {
 		return fmt.Errorf("Trying to close the already closed connection")
 	}
+	if c.shared {
+		c.connOpened = false
+		c.running = false
+		return nil
+	}
 
 	err := c.conn.Close()
 	c.connOpened = false
@@ -263,6 +297,25 @@ func (c *SSHClient) Stdout() io.Reader {
 	return c.remoteStdout
 }
 
+// fork returns client running its tasks in new sessions over c's connection.
+func (c *SSHClient) fork() Client {
+	return &SSHClient{
+		conn:       c.conn,
+		user:       c.user,
+		host:       c.host,
+		env:        c.env,
+		color:      c.color,
+		dialer:     c.dialer,
+		connOpened: c.connOpened,
+		shared:     true,
+	}
+}
+
+// pty reports whether the running task has pseudo terminal.
+func (c *SSHClient) pty() bool {
+	return c.stopResize != nil
+}
+
 func (c *SSHClient) Prefix() (string, int) {
 	host := c.user + "@" + c.host + " | "
 	return c.color + host + ResetColor, len(host)
@@ -276,6 +329,14 @@ func (c *SSHClient) WriteClose() error {
 	return c.remoteStdin.Close()
 }
 
+// kill kills the running task and closes its session, so that its output
+// and Wait don't wait for the remote command to exit.
+func (c *SSHClient) kill() error {
+	err := c.Signal(os.Kill)
+	c.sess.Close()
+	return err
+}
+
 func (c *SSHClient) Signal(sig os.Signal) error {
 	if !c.sessOpened {
 		return fmt.Errorf("session is not open")
@@ -288,8 +349,20 @@ func (c *SSHClient) Signal(sig os.Signal) error {
 		// which sounds like something that should be fixed/resolved
 		// upstream in the golang.org/x/crypto/ssh pkg.
 		// https://github.com/golang/go/issues/4115#issuecomment-66070418
-		c.remoteStdin.Write([]byte("\x03"))
+		// Without pseudo terminal, \x03 would be just an input byte.
+		if c.pty() {
+			_, err := c.remoteStdin.Write([]byte("\x03"))
+			return err
+		}
 		return c.sess.Signal(ssh.SIGINT)
+	case syscall.SIGTERM:
+		return c.sess.Signal(ssh.SIGTERM)
+	case syscall.SIGHUP:
+		return c.sess.Signal(ssh.SIGHUP)
+	case syscall.SIGQUIT:
+		return c.sess.Signal(ssh.SIGQUIT)
+	case os.Kill:
+		return c.sess.Signal(ssh.SIGKILL)
 	default:
 		return fmt.Errorf("%v not supported", sig)
 	}
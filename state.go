@@ -0,0 +1,195 @@
+package sup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// State records progress of a run in a local file, so that a failed run
+// can be resumed on the hosts that didn't complete it.
+type State struct {
+	Network   string              `json:"network"`
+	Args      []string            `json:"args"`      // Commands and targets to be run.
+	Env       []string            `json:"env"`       // Env vars set by the -e flags.
+	Hosts     []string            `json:"hosts"`     // Hosts of the run.
+	Time      string              `json:"sup_time"`  // SUP_TIME of the run.
+	Completed map[string][]string `json:"completed"` // Commands completed on each host.
+
+	path string
+	mu   sync.Mutex
+}
+
+// NewState returns an empty state to be saved to the path.
+func NewState(path string) *State {
+	return &State{path: path, Completed: map[string][]string{}}
+}
+
+// LoadState reads state of a previous run from the path.
+func LoadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("no failed run to be resumed")
+		}
+		return nil, err
+	}
+
+	s := NewState(path)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrapf(err, "parsing state file %v failed", path)
+	}
+	if s.Completed == nil {
+		s.Completed = map[string][]string{}
+	}
+	return s, nil
+}
+
+// Save writes the state file atomically.
+func (s *State) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+func (s *State) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".sup-state")
+	if err != nil {
+		return errors.Wrap(err, "writing state file failed")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing state file failed")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "writing state file failed")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), s.path), "writing state file failed")
+}
+
+// Remove deletes the state file, once the run succeeds.
+func (s *State) Remove() error {
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// done reports whether the host completed the command.
+func (s *State) done(host, cmd string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.Completed[host] {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// complete records the command as completed on the hosts and saves the state.
+func (s *State) complete(hosts []string, cmd string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, host := range hosts {
+		done := false
+		for _, c := range s.Completed[host] {
+			done = done || c == cmd
+		}
+		if !done {
+			s.Completed[host] = append(s.Completed[host], cmd)
+		}
+	}
+	return s.save()
+}
+
+// undo removes the command from the commands completed on the hosts
+// and saves the state.
+func (s *State) undo(hosts []string, cmd string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, host := range hosts {
+		var left []string
+		for _, c := range s.Completed[host] {
+			if c != cmd {
+				left = append(left, c)
+			}
+		}
+		s.Completed[host] = left
+	}
+	return s.save()
+}
+
+// progressHosts returns the hosts the command was completed on.
+// Commands run "once" or locally are completed for all the hosts.
+func (r *runner) progressHosts(cmd *Command, clients []Client) []string {
+	var hosts []string
+	for _, c := range clients {
+		if _, ok := r.index(c); cmd.Once || !ok {
+			return r.network.Hosts
+		}
+		hosts = append(hosts, r.host(c))
+	}
+	return hosts
+}
+
+// saveProgress records the command as completed on the clients.
+func (r *runner) saveProgress(cmd *Command, clients []Client) {
+	state := r.sup.state
+	if state == nil || r.undoing {
+		return
+	}
+	if err := state.complete(r.progressHosts(cmd, clients), cmd.Name); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// undoProgress removes the rolled back command from the state.
+func (r *runner) undoProgress(cmd *Command, clients []Client) {
+	state := r.sup.state
+	if state == nil {
+		return
+	}
+	if err := state.undo(r.progressHosts(cmd, clients), cmd.Name); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// pending returns the clients, whose hosts didn't complete the command
+// in the resumed run. Commands registering env vars are always run again,
+// since the registered values are not saved.
+func (r *runner) pending(cmd *Command, clients []Client) []Client {
+	state := r.sup.state
+	if state == nil || r.undoing || cmd.Register != "" {
+		return clients
+	}
+
+	var left []Client
+	for _, c := range clients {
+		if _, ok := r.index(c); !ok || !state.done(r.host(c), cmd.Name) {
+			left = append(left, c)
+			continue
+		}
+		r.skip(cmd, c)
+	}
+
+	switch {
+	case len(left) == 0:
+		fmt.Fprintf(os.Stderr, "%v: already completed, skipped\n", cmd.Name)
+	case len(left) < len(clients):
+		fmt.Fprintf(os.Stderr, "%v: resuming on %v of %v host(s)\n", cmd.Name, len(left), len(clients))
+	}
+	return left
+}
@@ -1,16 +1,19 @@
 package sup
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
-	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/goware/prefixer"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 const VERSION = "0.5"
@@ -19,6 +22,13 @@ type Stackup struct {
 	conf   *Supfile
 	debug  bool
 	prefix bool
+	socks  int
+	state  *State
+	logDir string
+	output string
+	quiet  bool
+
+	forceUnlock bool
 }
 
 func New(conf *Supfile) (*Stackup, error) {
@@ -27,219 +37,642 @@ func New(conf *Supfile) (*Stackup, error) {
 	}, nil
 }
 
-// Run runs set of commands on multiple hosts defined by network sequentially.
+// Run runs set of commands on multiple hosts defined by network sequentially,
+// or concurrently where the commands resolved by Supfile.Resolve don't depend
+// on each other.
+func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command) error {
+	_, err := sup.RunReport(network, envVars, commands...)
+	return err
+}
+
+// RunReport runs the commands as Run does and returns report of the results
+// of the commands on each host; it's nil, if the run failed before any command
+// was started.
 // TODO: This megamoth method needs a big refactor and should be split
 //       to multiple smaller methods.
-func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command) error {
+func (sup *Stackup) RunReport(network *Network, envVars EnvList, commands ...*Command) (*Report, error) {
 	if len(commands) == 0 {
-		return errors.New("no commands to be run")
+		return nil, errors.New("no commands to be run")
 	}
 
 	env := envVars.AsExport()
+	if sup.socks > 0 {
+		env += EnvVar{"SUP_PROXY", fmt.Sprintf("localhost:%d", sup.socks)}.AsExport()
+	}
 
-	// Create clients for every host (either SSH or Localhost).
+	// Create clients for every host, chosen by the host's URL scheme.
 	var bastion *SSHClient
+	var dialer SSHDialFunc
 	if network.Bastion != "" {
 		bastion = &SSHClient{}
 		if err := bastion.Connect(network.Bastion); err != nil {
-			return errors.Wrap(err, "connecting to bastion failed")
+			return nil, errors.Wrap(err, "connecting to bastion failed")
 		}
+		dialer = bastion.DialThrough
 	}
 
-	var wg sync.WaitGroup
-	clientCh := make(chan Client, len(network.Hosts))
-	errCh := make(chan error, len(network.Hosts))
-
-	for i, host := range network.Hosts {
-		wg.Add(1)
-		go func(i int, host string) {
-			defer wg.Done()
+	// Connect to the host. Clients are colored by index of the host.
+	dial := func(i int, host string) (Client, error) {
+		client, err := NewClient(host, ClientOptions{
+			Env:    env + `export SUP_HOST="` + host + `";`,
+			User:   network.User,
+			Color:  Colors[i%len(Colors)],
+			Dialer: dialer,
+		})
+		if err != nil {
+			return nil, err
+		}
 
-			// Localhost client.
-			if host == "localhost" {
-				local := &LocalhostClient{
-					env: env + `export SUP_HOST="` + host + `";`,
-				}
-				if err := local.Connect(host); err != nil {
-					errCh <- errors.Wrap(err, "connecting to localhost failed")
-					return
-				}
-				clientCh <- local
-				return
+		if err := client.Connect(host); err != nil {
+			if dialer != nil {
+				return nil, errors.Wrap(err, "connecting to remote host through bastion failed")
 			}
+			return nil, errors.Wrap(err, "connecting to remote host failed")
+		}
+		return client, nil
+	}
 
-			// SSH client.
-			remote := &SSHClient{
-				env:   env + `export SUP_HOST="` + host + `";`,
-				user:  network.User,
-				color: Colors[i%len(Colors)],
-			}
+	// Connect to all the hosts in parallel. More sets of clients are
+	// forked, if independent commands are run concurrently, see acquire.
+	connect := func() ([]Client, error) {
+		var wg sync.WaitGroup
+		clients := make([]Client, len(network.Hosts))
+		errs := make([]error, len(network.Hosts))
 
-			if bastion != nil {
-				if err := remote.ConnectWith(host, bastion.DialThrough); err != nil {
-					errCh <- errors.Wrap(err, "connecting to remote host through bastion failed")
-					return
-				}
-			} else {
-				if err := remote.Connect(host); err != nil {
-					errCh <- errors.Wrap(err, "connecting to remote host failed")
-					return
+		for i, host := range network.Hosts {
+			wg.Add(1)
+			go func(i int, host string) {
+				defer wg.Done()
+				clients[i], errs[i] = dial(i, host)
+			}(i, host)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				for _, client := range clients {
+					if client != nil {
+						client.Close()
+					}
 				}
+				return nil, errors.Wrap(err, "connecting to clients failed")
 			}
-			clientCh <- remote
-		}(i, host)
+		}
+		return clients, nil
 	}
-	wg.Wait()
-	close(clientCh)
-	close(errCh)
 
+	clients, err := connect()
+	if err != nil {
+		return nil, err
+	}
 	maxLen := 0
-	var clients []Client
-	for client := range clientCh {
-		if remote, ok := client.(*SSHClient); ok {
-			defer remote.Close()
-		}
+	hosts := map[Client]int{}
+	for i, client := range clients {
+		defer client.Close()
 		_, prefixLen := client.Prefix()
 		if prefixLen > maxLen {
 			maxLen = prefixLen
 		}
-		clients = append(clients, client)
+		hosts[client] = i
 	}
-	for err := range errCh {
-		return errors.Wrap(err, "connecting to clients failed")
+
+	// Open network tunnels and proxies for the whole run.
+	if len(network.Tunnels) > 0 {
+		tunnels, err := openTunnels(bastion, clients, network.Tunnels)
+		if err != nil {
+			return nil, err
+		}
+		defer tunnels.Close()
+		env += tunnels.AsExport()
 	}
+	if len(network.RemoteFwd) > 0 {
+		tunnels, err := forwardRemote(clients, network.RemoteFwd)
+		if err != nil {
+			return nil, err
+		}
+		defer tunnels.Close()
+	}
+	if sup.socks > 0 {
+		proxies, err := serveProxies(clients, sup.socks)
+		if err != nil {
+			return nil, err
+		}
+		defer proxies.Close()
+	}
+
+	r := &runner{
+		sup:     sup,
+		env:     env,
+		vars:    envVars,
+		bastion: bastion,
+		network: network,
+		dial:    dial,
+		connect: connect,
+		clients: clients,
+		idle:    [][]Client{clients},
+		hosts:   hosts,
+		maxLen:  maxLen,
+	}
+	defer func() {
+		for _, client := range r.extra {
+			client.Close()
+		}
+	}()
 
-	// Run command or run multiple commands defined by target sequentially.
-	for _, cmd := range commands {
-		// Translate command into task(s).
-		tasks, err := sup.createTasks(cmd, clients, env)
+	// Display progress instead of the output.
+	if sup.quiet {
+		r.progress = newProgress(os.Stdout, terminal.IsTerminal(int(os.Stdout.Fd())))
+		defer r.progress.Close()
+	}
+
+	// Forward signals to the running tasks.
+	defer r.trap()()
+
+	// Hold the deploy lock for the whole run.
+	if network.Lock != nil && !network.Lock.disabled {
+		unlock, err := r.lock(network.Lock)
 		if err != nil {
-			return errors.Wrap(err, "creating task failed")
+			return nil, err
 		}
+		defer unlock()
+	}
 
-		// Run tasks sequentially.
-		for _, task := range tasks {
-			var writers []io.Writer
-			var wg sync.WaitGroup
+	// Run the commands in order of their dependencies.
+	start := time.Now()
+	err = r.runGraph(r.graph(commands))
+	rep := r.snapshot(start)
 
-			// Run tasks on the provided clients.
-			for _, c := range task.Clients {
-				var prefix string
-				var prefixLen int
-				if sup.prefix {
-					prefix, prefixLen = c.Prefix()
-					if len(prefix) < maxLen { // Left padding.
-						prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-					}
+	if sup.logDir != "" {
+		if err := r.writeSummary(rep, err); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+	return rep, err
+}
+
+// runner holds state of a single Stackup.Run.
+type runner struct {
+	sup        *Stackup
+	env        string  // Env vars exported to all the commands.
+	vars       EnvList // Env vars as passed to Stackup.Run.
+	bastion    *SSHClient
+	network    *Network
+	dial       func(int, string) (Client, error) // Connects client of the host.
+	connect    func() ([]Client, error)          // Connects new set of clients of all the hosts.
+	clients    []Client                          // Clients of all the hosts, in order.
+	extra      []Client                          // Clients forked for concurrent commands.
+	idle       [][]Client                        // Sets of clients not running any command.
+	hosts      map[Client]int                    // Index of each client's host.
+	maxLen     int                               // Max length of the hosts' prefixes.
+	journal    []step                            // Completed steps, in order.
+	registered registered                        // Env vars registered by the commands.
+	failed     []Client                          // Clients the failed step failed on.
+	undoing    bool                              // Are the rollback commands being run?
+	stopped    bool                              // Was the run interrupted?
+	report     report                            // Results of the commands.
+	progress   *progress                         // Progress of the commands, see Stackup.Quiet.
+	signals    signals                           // Signals forwarded to the running tasks.
+
+	mu sync.Mutex // Guards the state shared by concurrent commands.
+}
+
+// index returns index of the client's host. Clients of local commands
+// don't belong to any host.
+func (r *runner) index(c Client) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, ok := r.hosts[c]
+	return i, ok
+}
+
+// host returns host of the client. Clients of local commands run on localhost.
+func (r *runner) host(c Client) string {
+	if i, ok := r.index(c); ok {
+		return r.network.Hosts[i]
+	}
+	return "localhost"
+}
+
+// interrupt stops the run from starting any more commands.
+func (r *runner) interrupt() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+}
+
+// interrupted returns error, if the run was interrupted.
+func (r *runner) interrupted() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return ErrInterrupted
+	}
+	return nil
+}
+
+// fail records the clients the step failed on.
+func (r *runner) fail(clients []Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = append(r.failed, clients...)
+}
+
+// prefix returns left-padded prefix of the client's output lines.
+func (r *runner) prefix(c Client) string {
+	if !r.sup.prefix {
+		return ""
+	}
+	prefix, prefixLen := c.Prefix()
+	if len(prefix) < r.maxLen { // Left padding.
+		prefix = strings.Repeat(" ", r.maxLen-prefixLen) + prefix
+	}
+	return prefix
+}
+
+// runSerialTarget runs all the target's commands on one batch of hosts
+// before moving on to the next batch. Commands with "once: true" are run
+// with the first batch only.
+func (r *runner) runSerialTarget(name string, serial Serial, commands []*Command, clients []Client) error {
+	batches := serial.Batches(len(clients))
+	i := 0
+	for batch, size := range batches {
+		fmt.Fprintf(os.Stderr, "%v: batch %v/%v (%v hosts)\n", name, batch+1, len(batches), size)
+
+		for _, cmd := range commands {
+			if cmd.Once && batch > 0 {
+				continue
+			}
+			if err := r.interrupted(); err != nil {
+				return err
+			}
+			if err := r.runCommand(cmd, clients[i:i+size]); err != nil {
+				if left := len(batches) - batch - 1; left > 0 {
+					return errors.Wrapf(err, "%v: batch %v/%v failed, aborting remaining %v batch(es)", name, batch+1, len(batches), left)
 				}
+				return err
+			}
+		}
+		i += size
+	}
+	return nil
+}
 
-				err := c.Run(task)
-				if err != nil {
-					return errors.Wrap(err, prefix+"task failed")
+// runCommand runs the command's tasks on the clients sequentially.
+func (r *runner) runCommand(cmd *Command, clients []Client) error {
+	env := r.env
+
+	// Skip the command, unless the local env vars condition holds.
+	if cmd.WhenEnv != "" {
+		ok, err := evalWhenEnv(cmd.WhenEnv, env)
+		if err != nil {
+			return errors.Wrap(err, cmd.Name)
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%v: skipped (when_env: %v)\n", cmd.Name, cmd.WhenEnv)
+			for _, c := range clients {
+				r.skip(cmd, c)
+			}
+			return nil
+		}
+	}
+
+	// Skip the hosts, which completed the command in the resumed run.
+	clients = r.pending(cmd, clients)
+	if len(clients) == 0 {
+		return nil
+	}
+
+	// Skip the hosts, where the command's conditions don't hold.
+	clients, err := r.filterHosts(cmd, clients)
+	if err != nil {
+		return err
+	}
+	if len(clients) == 0 {
+		return nil
+	}
+
+	// Open command tunnels for the time of the command.
+	if len(cmd.Tunnels) > 0 {
+		tunnels, err := openTunnels(r.bastion, clients, cmd.Tunnels)
+		if err != nil {
+			return errors.Wrap(err, cmd.Name)
+		}
+		defer tunnels.Close()
+		env += tunnels.AsExport()
+	}
+	if len(cmd.RemoteFwd) > 0 {
+		tunnels, err := forwardRemote(clients, cmd.RemoteFwd)
+		if err != nil {
+			return errors.Wrap(err, cmd.Name)
+		}
+		defer tunnels.Close()
+	}
+
+	// Print the final progress, once the command finishes.
+	if r.progress != nil {
+		defer r.progress.end(cmd.Name)
+	}
+
+	// Translate command into task(s).
+	tasks, err := r.sup.createTasks(cmd, clients, env)
+	if err != nil {
+		return errors.Wrap(err, "creating task failed")
+	}
+
+	// Run tasks sequentially.
+	for i, task := range tasks {
+		if err := r.interrupted(); err != nil {
+			return err
+		}
+		// Gate each batch once, before any of its tasks, ie. uploads.
+		if task.Batch > 0 && tasks[i-1].Batch != task.Batch {
+			if err := waitForBatch(cmd, task); err != nil {
+				return err
+			}
+		}
+
+		var writers []io.Writer
+		var wg sync.WaitGroup
+		outputs := map[Client]*bytes.Buffer{}
+		streams := map[Client]*sync.WaitGroup{} // I/O operations of each client.
+
+		// Grouped and diff output is printed as blocks,
+		// quiet output only on failure.
+		var out *blocks
+		if r.sup.quiet {
+			out = r.newBlocks(cmd, task.Clients, outputQuiet)
+		} else if r.sup.output == OutputGrouped || r.sup.output == OutputDiff {
+			out = r.newBlocks(cmd, task.Clients, r.sup.output)
+		}
+
+		// Run tasks on the provided clients.
+		var started []Client
+		for _, c := range task.Clients {
+			prefix := r.prefix(c)
+
+			log, tail := r.begin(cmd, c)
+			err := c.Run(r.withVars(task, c))
+			if err != nil {
+				r.finish(cmd, c, err)
+				r.abort(cmd, started, streams)
+				if out != nil {
+					out.flush()
 				}
+				return errors.Wrap(err, prefix+"task failed")
+			}
+			started = append(started, c)
+			r.running(c)
 
-				// Copy over tasks's STDOUT.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stdout, prefixer.New(c.Stdout(), prefix))
-					if err != nil && err != io.EOF {
-						// TODO: io.Copy() should not return io.EOF at all.
-						// Upstream bug? Or prefixer.WriteTo() bug?
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
-					}
-				}(c)
-
-				// Copy over tasks's STDERR.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stderr, prefixer.New(c.Stderr(), prefix))
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDERR failed"))
-					}
-				}(c)
+			// Capture the output to be registered as env var.
+			stdout, stderr := c.Stdout(), c.Stderr()
+			if cmd.Register != "" && task.Final {
+				outputs[c] = &bytes.Buffer{}
+				stdout = io.TeeReader(stdout, outputs[c])
+			}
 
-				writers = append(writers, c.Stdin())
+			// Log the output to the host's log file.
+			if log != nil {
+				stdout = io.TeeReader(stdout, log)
+				stderr = io.TeeReader(stderr, log)
 			}
+			// STDERR is merged into STDOUT by pseudo terminal.
+			if withPty([]Client{c}) {
+				stdout = io.TeeReader(stdout, tail)
+			}
+			stderr = io.TeeReader(stderr, tail)
 
-			// Copy over task's STDIN.
-			if task.Input != nil {
-				go func() {
-					writer := io.MultiWriter(writers...)
-					_, err := io.Copy(writer, task.Input)
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
-					}
-					// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
-					for _, c := range clients {
-						c.WriteClose()
-					}
-				}()
+			// Prefix the output lines, or buffer the output as a block.
+			var outW, errW io.Writer = os.Stdout, os.Stderr
+			if out != nil {
+				outW, errW = out.writer(c), out.writer(c)
+			} else {
+				stdout, stderr = prefixer.New(stdout, prefix), prefixer.New(stderr, prefix)
 			}
 
-			// Catch OS signals and pass them to all active clients.
-			trap := make(chan os.Signal, 1)
-			signal.Notify(trap, os.Interrupt)
+			// Copy over tasks's STDOUT.
+			ioDone := &sync.WaitGroup{}
+			ioDone.Add(2)
+			streams[c] = ioDone
+			go func(c Client, stdout io.Reader, ioDone *sync.WaitGroup) {
+				defer ioDone.Done()
+				_, err := io.Copy(outW, stdout)
+				if err != nil && err != io.EOF && !r.killed(c) {
+					// TODO: io.Copy() should not return io.EOF at all.
+					// Upstream bug? Or prefixer.WriteTo() bug?
+					fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
+				}
+				if out != nil {
+					out.close(c)
+				}
+			}(c, stdout, ioDone)
+
+			// Copy over tasks's STDERR.
+			go func(c Client, stderr io.Reader, ioDone *sync.WaitGroup) {
+				defer ioDone.Done()
+				_, err := io.Copy(errW, stderr)
+				if err != nil && err != io.EOF && !r.killed(c) {
+					fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDERR failed"))
+				}
+				if out != nil {
+					out.close(c)
+				}
+			}(c, stderr, ioDone)
+
+			writers = append(writers, c.Stdin())
+		}
+
+		// Pass all the keys over to the interactive task,
+		// if the remote terminals handle them.
+		restore := func() {}
+		if interactive(task) && withPty(task.Clients) {
+			if raw, err := rawTerminal(); err == nil {
+				restore = raw
+			}
+		}
+
+		// Copy over task's STDIN.
+		if task.Input != nil {
 			go func() {
-				for {
-					select {
-					case sig, ok := <-trap:
-						if !ok {
-							return
-						}
-						for _, c := range task.Clients {
-							err := c.Signal(sig)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "sending signal failed"))
-							}
-						}
-					}
+				writer := io.MultiWriter(writers...)
+				_, err := io.Copy(writer, task.Input)
+				if err != nil && err != io.EOF {
+					fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
+				}
+				// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
+				for _, c := range task.Clients {
+					c.Stdin().Close()
 				}
 			}()
+		}
 
-			// Wait for all I/O operations first.
-			wg.Wait()
+		// Make sure each client finishes the task, once all of its
+		// I/O operations are done, collect the failures.
+		type failure struct {
+			client Client
+			err    error
+		}
+		failures := make(chan failure, len(task.Clients))
+		for _, c := range task.Clients {
+			wg.Add(1)
+			go func(c Client, streams *sync.WaitGroup) {
+				defer wg.Done()
+				streams.Wait()
+				err := c.Wait()
+				r.finish(cmd, c, err)
+				if r.exited(c) {
+					c.Close()
+				}
+				if err != nil {
+					if r.sup.quiet {
+						out.fail(c, err)
+					} else {
+						fmt.Fprintf(os.Stderr, "%s%v\n", r.prefix(c), err)
+					}
+					failures <- failure{c, err}
+				}
+			}(c, streams[c])
+		}
+
+		// Wait for all commands to finish.
+		wg.Wait()
+		close(failures)
+		restore()
+		if out != nil {
+			out.flush()
+		}
+
+		failed := map[Client]bool{}
+		var firstErr error
+		for f := range failures {
+			failed[f.client] = true
+			if firstErr == nil {
+				firstErr = f.err
+			}
+		}
 
-			// Make sure each client finishes the task, return on failure.
+		// Remember the clients that completed the command, so it can be rolled back.
+		if task.Final {
+			var completed []Client
 			for _, c := range task.Clients {
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					if err := c.Wait(); err != nil {
-						var prefix string
-						if sup.prefix {
-							var prefixLen int
-							prefix, prefixLen = c.Prefix()
-							if len(prefix) < maxLen { // Left padding.
-								prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-							}
-						}
-						if e, ok := err.(*ssh.ExitError); ok && e.ExitStatus() != 15 {
-							// TODO: Store all the errors, and print them after Wait().
-							fmt.Fprintf(os.Stderr, "%s%v\n", prefix, e)
-							os.Exit(e.ExitStatus())
-						}
-						fmt.Fprintf(os.Stderr, "%s%v\n", prefix, err)
-
-						// TODO: Shouldn't os.Exit(1) here. Instead, collect the exit statuses for later.
-						os.Exit(1)
+				if !failed[c] {
+					completed = append(completed, c)
+					if cmd.Register != "" {
+						r.register(cmd, c, outputs[c].String())
 					}
-				}(c)
+				}
+			}
+			r.complete(cmd, completed)
+		}
+
+		// Return on failure, don't run the remaining batches.
+		if len(failed) > 0 {
+			var clients []Client
+			for _, c := range task.Clients {
+				if failed[c] {
+					clients = append(clients, c)
+				}
 			}
+			r.fail(clients)
 
-			// Wait for all commands to finish.
-			wg.Wait()
+			err := ErrTaskFailed{
+				Failed:     len(failed),
+				ExitStatus: exitStatus(firstErr),
+			}
+			if left := task.Batches - task.Batch - 1; left > 0 {
+				return errors.Wrapf(err, "%v: batch %v/%v failed, aborting remaining %v batch(es)", cmd.Name, task.Batch+1, task.Batches, left)
+			}
+			return err
+		}
 
-			// Stop catching signals for the currently active clients.
-			signal.Stop(trap)
-			close(trap)
+		// Don't proceed until all the hosts pass the health check.
+		if task.Final && cmd.WaitFor != nil {
+			if err := r.waitFor(cmd, task.Clients); err != nil {
+				if left := task.Batches - task.Batch - 1; left > 0 {
+					return errors.Wrapf(err, "batch %v/%v, aborting remaining %v batch(es)", task.Batch+1, task.Batches, left)
+				}
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
+// abort interrupts the task on the clients it was already started on,
+// when it couldn't be started on all of them, and waits for it to exit.
+func (r *runner) abort(cmd *Command, clients []Client, streams map[Client]*sync.WaitGroup) {
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c Client, streams *sync.WaitGroup) {
+			defer wg.Done()
+			c.Signal(os.Interrupt)
+			c.Stdin().Close()
+			streams.Wait()
+			r.finish(cmd, c, c.Wait())
+			if r.exited(c) {
+				c.Close()
+			}
+		}(c, streams[c])
+	}
+	wg.Wait()
+}
+
+// openTunnels opens local port forwards through the bastion host,
+// or through the first SSH host of the network.
+func openTunnels(bastion *SSHClient, clients []Client, tunnels []Tunnel) (*Tunnels, error) {
+	via := bastion
+	for _, c := range clients {
+		if via != nil {
+			break
+		}
+		if remote, ok := c.(*SSHClient); ok {
+			via = remote
+		}
+	}
+	if via == nil {
+		return nil, errors.New("tunnels require a bastion or at least one SSH host")
+	}
+
+	return via.OpenTunnels(tunnels)
+}
+
+// forwardRemote opens remote port forwards on all SSH hosts.
+func forwardRemote(clients []Client, tunnels []Tunnel) (*Tunnels, error) {
+	all := &Tunnels{}
+	for _, c := range clients {
+		remote, ok := c.(*SSHClient)
+		if !ok {
+			continue
+		}
+		t, err := remote.ForwardRemote(tunnels)
+		if err != nil {
+			all.Close()
+			return nil, err
+		}
+		all.Add(t)
+	}
+	return all, nil
+}
+
+// serveProxies serves SOCKS5/HTTP proxy on the given port of all SSH hosts.
+func serveProxies(clients []Client, port int) (*Tunnels, error) {
+	all := &Tunnels{}
+	for _, c := range clients {
+		remote, ok := c.(*SSHClient)
+		if !ok {
+			continue
+		}
+		t, err := remote.ServeProxy(strconv.Itoa(port))
+		if err != nil {
+			all.Close()
+			return nil, err
+		}
+		all.Add(t)
+	}
+	return all, nil
+}
+
 func (sup *Stackup) Debug(value bool) {
 	sup.debug = value
 }
@@ -247,3 +680,74 @@ func (sup *Stackup) Debug(value bool) {
 func (sup *Stackup) Prefix(value bool) {
 	sup.prefix = value
 }
+
+// Socks serves SOCKS5/HTTP proxy on the given port of the remote hosts
+// during the whole run. The proxy dials out from localhost.
+func (sup *Stackup) Socks(port int) {
+	sup.socks = port
+}
+
+// LogDir writes output of each command on each host to DIR/<run-id>/<host>/<command>.log
+// and results of the run to DIR/<run-id>/summary.json.
+func (sup *Stackup) LogDir(dir string) {
+	sup.logDir = dir
+}
+
+// Output sets how the output of the hosts is printed, see OutputStream,
+// OutputGrouped and OutputDiff. Output is streamed by default.
+func (sup *Stackup) Output(mode string) error {
+	switch mode {
+	case "", OutputStream, OutputGrouped, OutputDiff:
+		sup.output = mode
+		return nil
+	}
+	return fmt.Errorf("unknown output mode %q, expected %v, %v or %v", mode, OutputStream, OutputGrouped, OutputDiff)
+}
+
+// Quiet prints output of the hosts only if they fail. Progress of the commands
+// is displayed instead, redrawn while the commands run, if STDOUT is a terminal.
+func (sup *Stackup) Quiet(value bool) {
+	sup.quiet = value
+}
+
+// ForceUnlock removes the network's lock left by another run,
+// before acquiring it.
+func (sup *Stackup) ForceUnlock(value bool) {
+	sup.forceUnlock = value
+}
+
+// State records progress of the run to the state. Commands, which the state
+// records as completed on a host by the resumed run, are skipped there.
+func (sup *Stackup) State(state *State) {
+	sup.state = state
+}
+
+// waitForBatch pauses and/or asks for confirmation before
+// the next serial batch of the command.
+func waitForBatch(cmd *Command, task *Task) error {
+	if cmd.Pause != "" {
+		pause, _ := time.ParseDuration(cmd.Pause) // Validated by NewSupfile.
+		fmt.Fprintf(os.Stderr, "%v: pausing %v before batch %v/%v\n", cmd.Name, pause, task.Batch+1, task.Batches)
+		time.Sleep(pause)
+	}
+
+	if cmd.Confirm {
+		// Read the answer from the terminal, since STDIN might be piped.
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			tty = os.Stdin
+		} else {
+			defer tty.Close()
+		}
+
+		fmt.Fprintf(os.Stderr, "%v: continue with batch %v/%v (%v hosts)? [y/N] ", cmd.Name, task.Batch+1, task.Batches, len(task.Clients))
+		answer, _ := bufio.NewReader(tty).ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+		default:
+			return fmt.Errorf("%v: aborted, skipping remaining %v batch(es)", cmd.Name, task.Batches-task.Batch)
+		}
+	}
+
+	return nil
+}
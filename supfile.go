@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -24,10 +27,14 @@ type Supfile struct {
 
 // Network is group of hosts with extra custom env vars.
 type Network struct {
-	Env       EnvList  `yaml:"env"`
-	Inventory string   `yaml:"inventory"`
-	Hosts     []string `yaml:"hosts"`
-	Bastion   string   `yaml:"bastion"` // Jump host for the environment
+	Env       EnvList       `yaml:"env"`
+	Inventory string        `yaml:"inventory"`
+	Pods      *PodInventory `yaml:"pods"` // Kubernetes pods selected by labels
+	Hosts     []string      `yaml:"hosts"`
+	Bastion   string        `yaml:"bastion"`        // Jump host for the environment
+	Tunnels   []Tunnel      `yaml:"tunnels"`        // Local port forwards open during the whole run
+	RemoteFwd []Tunnel      `yaml:"remote_forward"` // Remote port forwards open during the whole run
+	Lock      *Lock         `yaml:"lock"`           // Deploy lock held during the whole run
 
 	// Should these live on Hosts too? We'd have to change []string to struct, even in Supfile.
 	User         string // `yaml:"user"`
@@ -67,18 +74,109 @@ func (n *Networks) Get(name string) (Network, bool) {
 
 // Command represents command(s) to be run remotely.
 type Command struct {
-	Name   string   `yaml:"-"`      // Command name.
-	Desc   string   `yaml:"desc"`   // Command description.
-	Local  string   `yaml:"local"`  // Command(s) to be run locally.
-	Run    string   `yaml:"run"`    // Command(s) to be run remotelly.
-	Script string   `yaml:"script"` // Load command(s) from script and run it remotelly.
-	Upload []Upload `yaml:"upload"` // See Upload struct.
-	Stdin  bool     `yaml:"stdin"`  // Attach localhost STDOUT to remote commands' STDIN?
-	Once   bool     `yaml:"once"`   // The command should be run "once" (on one host only).
-	Serial int      `yaml:"serial"` // Max number of clients processing a task in parallel.
+	Name      string   `yaml:"-"`              // Command name.
+	Target    string   `yaml:"-"`              // Name of the target the command was run by.
+	DependsOn []string `yaml:"depends_on"`     // Commands to be run before this one.
+	Desc      string   `yaml:"desc"`           // Command description.
+	Local     string   `yaml:"local"`          // Command(s) to be run locally.
+	Run       string   `yaml:"run"`            // Command(s) to be run remotelly.
+	Script    string   `yaml:"script"`         // Load command(s) from script and run it remotelly.
+	Upload    []Upload `yaml:"upload"`         // See Upload struct.
+	Release   *Release `yaml:"release"`        // See Release struct.
+	Stdin     bool     `yaml:"stdin"`          // Attach localhost STDOUT to remote commands' STDIN?
+	Once      bool     `yaml:"once"`           // The command should be run "once" (on one host only).
+	Serial    Serial   `yaml:"serial"`         // Max number of clients processing a task in parallel.
+	Pause     string   `yaml:"pause"`          // Pause between serial batches, ie. "30s".
+	Confirm   bool     `yaml:"confirm"`        // Ask for confirmation before the next serial batch.
+	WaitFor   *WaitFor `yaml:"wait_for"`       // Health check gating the next serial batch.
+	When      string   `yaml:"when"`           // Run on the hosts, where the condition exits with zero status.
+	Unless    string   `yaml:"unless"`         // Skip the hosts, where the condition exits with zero status.
+	WhenEnv   string   `yaml:"when_env"`       // Run only if the local env vars condition holds, ie. "SUP_NETWORK == prod".
+	Register  string   `yaml:"register"`       // Env var capturing the command's output on each host for later commands.
+	Rollback  string   `yaml:"rollback"`       // Command(s) undoing the command, run if a later command fails.
+	Tunnels   []Tunnel `yaml:"tunnels"`        // Local port forwards open while the command runs.
+	RemoteFwd []Tunnel `yaml:"remote_forward"` // Remote port forwards open while the command runs.
 
 	// API backward compatibility. Will be deprecated in v1.0.
 	RunOnce bool `yaml:"run_once"` // The command should be run once only.
+
+	deps     []*Command // Commands to be completed before this one, see Supfile.Resolve.
+	parents  []string   // Targets including the command, outermost first.
+	resolved bool       // Was the command resolved by Supfile.Resolve?
+}
+
+// Serial limits number of hosts processing a task at once. It's either a fixed
+// batch size (2), a percentage of hosts (25%) or a list of batch sizes
+// ([1, 10%, 50%]), where the last size repeats until all hosts are processed.
+type Serial []string
+
+func (s *Serial) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items []interface{}
+	if err := unmarshal(&items); err != nil {
+		var item interface{}
+		if err := unmarshal(&item); err != nil {
+			return err
+		}
+		if item == nil || fmt.Sprintf("%v", item) == "0" {
+			// serial: 0 (or empty) disables batching.
+			*s = nil
+			return nil
+		}
+		items = []interface{}{item}
+	}
+
+	*s = make(Serial, 0, len(items))
+	for _, item := range items {
+		size := strings.TrimSpace(fmt.Sprintf("%v", item))
+		if _, err := batchSize(size, 100); err != nil {
+			return err
+		}
+		*s = append(*s, size)
+	}
+
+	return nil
+}
+
+// batchSize returns number of hosts out of n hosts for the batch size
+// of the form "N" or "N%". Percentages are rounded up to at least one host.
+func batchSize(size string, n int) (int, error) {
+	if strings.HasSuffix(size, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(size, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("serial: invalid percentage %q", size)
+		}
+		return int(math.Ceil(float64(n) * percent / 100)), nil
+	}
+
+	hosts, err := strconv.Atoi(size)
+	if err != nil || hosts <= 0 {
+		return 0, fmt.Errorf("serial: invalid batch size %q", size)
+	}
+	return hosts, nil
+}
+
+// Batches splits n hosts into batches and returns their sizes.
+func (s Serial) Batches(n int) []int {
+	if len(s) == 0 {
+		return []int{n}
+	}
+
+	var batches []int
+	for i, done := 0, 0; done < n; i++ {
+		if i >= len(s) {
+			i = len(s) - 1 // The last batch size repeats.
+		}
+		size, err := batchSize(s[i], n)
+		if err != nil || size < 1 {
+			size = 1
+		}
+		if done+size > n {
+			size = n - done
+		}
+		batches = append(batches, size)
+		done += size
+	}
+	return batches
 }
 
 // Commands is a list of user-defined commands
@@ -112,10 +210,30 @@ func (c *Commands) Get(name string) (Command, bool) {
 	return cmd, ok
 }
 
+// Target is an alias for multiple commands and other targets. Its commands
+// can be run on serial batches of hosts, one whole batch at a time.
+type Target struct {
+	Commands  []string `yaml:"commands"`   // Names of the commands and targets to be run.
+	Serial    Serial   `yaml:"serial"`     // Run all the commands on batches of hosts.
+	Parallel  bool     `yaml:"parallel"`   // Run the commands concurrently, unless they depend on each other.
+	OnFailure string   `yaml:"on_failure"` // Target to be run on the hosts, if any of the commands fails.
+}
+
+func (t *Target) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// List of commands.
+	if err := unmarshal(&t.Commands); err == nil {
+		return nil
+	}
+
+	// Map with commands and options.
+	type target Target
+	return unmarshal((*target)(t))
+}
+
 // Targets is a list of user-defined targets
 type Targets struct {
 	Names   []string
-	targets map[string][]string
+	targets map[string]Target
 }
 
 func (t *Targets) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -138,9 +256,9 @@ func (t *Targets) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
-func (t *Targets) Get(name string) ([]string, bool) {
-	cmds, ok := t.targets[name]
-	return cmds, ok
+func (t *Targets) Get(name string) (Target, bool) {
+	target, ok := t.targets[name]
+	return target, ok
 }
 
 // Upload represents file copy operation from localhost Src path to Dst
@@ -210,6 +328,16 @@ func (e *EnvList) Set(key, value string) {
 	})
 }
 
+// value returns value of the env var, or an empty string.
+func (e EnvList) value(key string) string {
+	for _, v := range e {
+		if v.Key == key {
+			return v.Value
+		}
+	}
+	return ""
+}
+
 func (e *EnvList) ResolveValues() error {
 	if len(*e) == 0 {
 		return nil
@@ -292,7 +420,7 @@ func NewSupfile(data []byte) (*Supfile, error) {
 			if cmd.Local != "" {
 				return nil, ErrMustUpdate{"command.local is not supported in Supfile v" + conf.Version}
 			}
-			if cmd.Serial != 0 {
+			if len(cmd.Serial) != 0 {
 				return nil, ErrMustUpdate{"command.serial is not supported in Supfile v" + conf.Version}
 			}
 		}
@@ -324,26 +452,93 @@ func NewSupfile(data []byte) (*Supfile, error) {
 		return nil, ErrUnsupportedSupfileVersion{"unsupported Supfile version " + conf.Version}
 	}
 
+	for name, cmd := range conf.Commands.cmds {
+		if cmd.Pause != "" {
+			if _, err := time.ParseDuration(cmd.Pause); err != nil {
+				return nil, errors.Wrapf(err, "command %v: invalid pause", name)
+			}
+		}
+		if cmd.WaitFor != nil {
+			if err := cmd.WaitFor.validate(); err != nil {
+				return nil, errors.Wrapf(err, "command %v", name)
+			}
+		}
+		if cmd.Register != "" && !envNameRegexp.MatchString(cmd.Register) {
+			return nil, fmt.Errorf("command %v: invalid register env var name %q", name, cmd.Register)
+		}
+		if cmd.WhenEnv != "" {
+			if _, _, _, err := parseWhenEnv(cmd.WhenEnv); err != nil {
+				return nil, errors.Wrapf(err, "command %v", name)
+			}
+		}
+		for _, dep := range cmd.DependsOn {
+			if _, ok := conf.Commands.Get(dep); !ok {
+				return nil, fmt.Errorf("command %v: unknown depends_on command %v", name, dep)
+			}
+		}
+		if cmd.Release != nil {
+			if err := cmd.Release.validate(&cmd); err != nil {
+				return nil, errors.Wrapf(err, "command %v", name)
+			}
+			// Switch back to the previous release, if a later command fails.
+			if cmd.Rollback == "" {
+				cmd.Rollback = cmd.Release.rollbackScript()
+				conf.Commands.cmds[name] = cmd
+			}
+		}
+	}
+	if err := conf.checkCycles(); err != nil {
+		return nil, err
+	}
+	for name, target := range conf.Targets.targets {
+		if len(target.Serial) != 0 && target.Parallel {
+			return nil, fmt.Errorf("target %v: serial and parallel can't be combined", name)
+		}
+		if target.OnFailure != "" {
+			if _, ok := conf.Targets.Get(target.OnFailure); !ok {
+				return nil, fmt.Errorf("target %v: unknown on_failure target %v", name, target.OnFailure)
+			}
+			if _, err := conf.Resolve(target.OnFailure); err != nil {
+				return nil, errors.Wrapf(err, "target %v", target.OnFailure)
+			}
+		}
+	}
+
 	return &conf, nil
 }
 
 // ParseInventory runs the inventory command, if provided, and appends
 // the command's output lines to the manually defined list of hosts.
+// Kubernetes pods selected by n.Pods are listed first.
 func (n Network) ParseInventory() ([]string, error) {
+	return n.ParseInventoryWith(os.Stderr)
+}
+
+// ParseInventoryWith is like ParseInventory, but the inventory command's
+// STDERR is written to stderr.
+func (n Network) ParseInventoryWith(stderr io.Writer) ([]string, error) {
+	var hosts []string
+	if n.Pods != nil {
+		pods, err := n.Pods.Hosts()
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, pods...)
+	}
+
 	if n.Inventory == "" {
-		return nil, nil
+		return hosts, nil
 	}
 
 	cmd := exec.Command("/bin/sh", "-c", n.Inventory)
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, n.Env.Slice()...)
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = stderr
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, err
 	}
 
-	var hosts []string
 	buf := bytes.NewBuffer(output)
 	for {
 		host, err := buf.ReadString('\n')
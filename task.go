@@ -5,8 +5,10 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 )
 
 // Task represents a set of commands to be run.
@@ -15,51 +17,42 @@ type Task struct {
 	Input   io.Reader
 	Clients []Client
 	TTY     bool
+	Batch   int  // Serial batch number, counted from 0.
+	Batches int  // Total number of serial batches.
+	Final   bool // Does the task complete the command on its clients?
 }
 
 func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*Task, error) {
-	var tasks []*Task
+	if cmd.Release != nil {
+		return sup.releaseTasks(cmd, clients, env)
+	}
+
+	var steps []taskStep
 
 	cwd, err := os.Getwd()
 	if err != nil {
 		return nil, errors.Wrap(err, "resolving CWD failed")
 	}
 
-	// Anything to upload?
+	// Anything to upload? The tar stream is read once, so each batch
+	// gets its own.
 	for _, upload := range cmd.Upload {
+		upload := upload
 		uploadFile, err := ResolveLocalPath(cwd, upload.Src, env)
 		if err != nil {
 			return nil, errors.Wrap(err, "upload: "+upload.Src)
 		}
-		uploadTarReader, err := NewTarStreamReader(cwd, uploadFile, upload.Exc)
-		if err != nil {
-			return nil, errors.Wrap(err, "upload: "+upload.Src)
-		}
-
-		task := Task{
-			Run:   RemoteTarCommand(upload.Dst),
-			Input: uploadTarReader,
-			TTY:   false,
-		}
-
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
+		steps = append(steps, func() (Task, error) {
+			uploadTarReader, err := NewTarStreamReader(cwd, uploadFile, upload.Exc)
+			if err != nil {
+				return Task{}, errors.Wrap(err, "upload: "+upload.Src)
 			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
-		}
+			return Task{
+				Run:   RemoteTarCommand(upload.Dst),
+				Input: uploadTarReader,
+				TTY:   false,
+			}, nil
+		})
 	}
 
 	// Script. Read the file as a multiline input command.
@@ -83,24 +76,7 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		if cmd.Stdin {
 			task.Input = os.Stdin
 		}
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
-			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
-		}
+		steps = append(steps, func() (Task, error) { return task, nil })
 	}
 
 	// Local command.
@@ -109,7 +85,7 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 			env: env + `export SUP_HOST="localhost";`,
 		}
 		local.Connect("localhost")
-		task := &Task{
+		task := Task{
 			Run:     cmd.Local,
 			Clients: []Client{local},
 			TTY:     true,
@@ -120,7 +96,7 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		if cmd.Stdin {
 			task.Input = os.Stdin
 		}
-		tasks = append(tasks, task)
+		steps = append(steps, func() (Task, error) { return task, nil })
 	}
 
 	// Remote command.
@@ -135,26 +111,52 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		if cmd.Stdin {
 			task.Input = os.Stdin
 		}
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
+		steps = append(steps, func() (Task, error) { return task, nil })
+	}
+
+	return batchTasks(cmd, clients, steps)
+}
+
+// taskStep creates a task of the command. It's called for each batch of clients.
+type taskStep func() (Task, error)
+
+// batchTasks assigns the steps' tasks to the clients. Serial tasks are split
+// into batches of clients, which are executed sequentially: all the tasks
+// of a batch, before any of the next batch. The last task of each batch
+// completes the command on the batch's clients. Tasks with their own
+// clients, ie. local commands, are run with the first batch only.
+func batchTasks(cmd *Command, clients []Client, steps []taskStep) ([]*Task, error) {
+	sizes := []int{1}
+	if !cmd.Once {
+		sizes = cmd.Serial.Batches(len(clients))
+	}
+
+	var tasks []*Task
+	i := 0
+	for batch, size := range sizes {
+		n := len(tasks)
+		for _, step := range steps {
+			task, err := step()
+			if err != nil {
+				return nil, err
+			}
+			if task.Clients != nil {
+				if batch > 0 {
+					continue
 				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
+				task.Batches = 1
+			} else {
+				task.Clients = clients[i : i+size]
+				task.Batch = batch
+				task.Batches = len(sizes)
 			}
-		} else {
-			task.Clients = clients
 			tasks = append(tasks, &task)
 		}
+		if len(tasks) > n {
+			tasks[len(tasks)-1].Final = true
+		}
+		i += size
 	}
-
 	return tasks, nil
 }
 
@@ -166,3 +168,32 @@ type ErrTask struct {
 func (e ErrTask) Error() string {
 	return fmt.Sprintf(`Run("%v"): %v`, e.Task, e.Reason)
 }
+
+// ErrTaskFailed is returned when the task fails on some of the hosts.
+type ErrTaskFailed struct {
+	Failed     int // Number of hosts the task failed on.
+	ExitStatus int // Exit status of the first failed host.
+}
+
+func (e ErrTaskFailed) Error() string {
+	return fmt.Sprintf("task failed on %v host(s)", e.Failed)
+}
+
+// ErrInterrupted is returned when the run was interrupted
+// before all the commands were started.
+var ErrInterrupted = errors.New("interrupted")
+
+// exitStatus returns exit status of the failed remote or local command.
+func exitStatus(err error) int {
+	switch e := err.(type) {
+	case *ssh.ExitError:
+		if e.ExitStatus() != 15 {
+			return e.ExitStatus()
+		}
+	case *exec.ExitError:
+		if e.ExitCode() > 0 {
+			return e.ExitCode()
+		}
+	}
+	return 1
+}
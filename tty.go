@@ -0,0 +1,100 @@
+package sup
+
+import (
+	"os"
+	"os/signal"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+// terminalSize returns size of the local terminal, or 80x40, if STDOUT
+// isn't a terminal.
+func terminalSize() (width, height int) {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 40
+	}
+	return width, height
+}
+
+// terminalType returns type of the local terminal, ie. $TERM, or "xterm".
+func terminalType() string {
+	if term := os.Getenv("TERM"); term != "" {
+		return term
+	}
+	return "xterm"
+}
+
+// interactive reports whether the task is run interactively, ie. with
+// the local terminal's STDIN and STDOUT.
+func interactive(task *Task) bool {
+	return task.TTY && task.Input == os.Stdin && isTerminal(os.Stdin) && isTerminal(os.Stdout)
+}
+
+// withPty reports whether all the clients run the task in pseudo terminal.
+func withPty(clients []Client) bool {
+	for _, c := range clients {
+		if c, ok := c.(interface{ pty() bool }); !ok || !c.pty() {
+			return false
+		}
+	}
+	return len(clients) > 0
+}
+
+// rawTerminal puts the local terminal into raw mode, so that all the keys,
+// including Ctrl-C, are passed over to the interactive task. It returns
+// function restoring the terminal.
+func rawTerminal() (restore func(), err error) {
+	fd := int(os.Stdin.Fd())
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return func() { terminal.Restore(fd, state) }, nil
+}
+
+// requestPty requests pseudo terminal of the local terminal's size and type
+// for the session, and keeps its size in sync with the local terminal.
+// Interactive sessions echo the input, since the local terminal is in raw
+// mode. It returns function stopping the sync.
+func requestPty(sess *ssh.Session, echo bool) (stop func(), err error) {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0,     // disable echoing
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+	if echo {
+		modes[ssh.ECHO] = 1
+	}
+	width, height := terminalSize()
+	if err := sess.RequestPty(terminalType(), height, width, modes); err != nil {
+		return nil, err
+	}
+
+	resize := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	if len(resizeSignals) > 0 {
+		signal.Notify(resize, resizeSignals...)
+	}
+	go func() {
+		for {
+			select {
+			case <-resize:
+				width, height := terminalSize()
+				sess.WindowChange(height, width)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(resize)
+		close(done)
+	}, nil
+}
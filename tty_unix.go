@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package sup
+
+import (
+	"os"
+	"syscall"
+)
+
+// resizeSignals are sent when the local terminal is resized.
+var resizeSignals = []os.Signal{syscall.SIGWINCH}
@@ -0,0 +1,7 @@
+package sup
+
+import "os"
+
+// resizeSignals are sent when the local terminal is resized.
+// There's no such signal on Windows.
+var resizeSignals []os.Signal
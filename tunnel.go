@@ -0,0 +1,235 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Tunnel represents a local port forwarded to a remote address
+// through an established SSH connection (bastion or the first SSH host).
+//
+// As a remote forward, the remote host listens on Remote address
+// and the connections are forwarded to the Local address instead.
+type Tunnel struct {
+	Local  string `yaml:"local"`  // Local port (or addr:port) to listen on. Port 0 picks a free port.
+	Remote string `yaml:"remote"` // Address dialed from the other end of the SSH connection.
+	Env    string `yaml:"env"`    // Env var exposing the bound local port, defaults to $SUP_TUNNEL_PORT[_N].
+}
+
+// tunnelAddr normalizes port-only addresses, ie. "5432" => "127.0.0.1:5432".
+func tunnelAddr(addr string) string {
+	if strings.Index(addr, ":") == -1 {
+		return "127.0.0.1:" + addr
+	}
+	return addr
+}
+
+// envName returns name of the env var exposing the i-th tunnel's local port.
+func (t Tunnel) envName(i int) string {
+	if t.Env != "" {
+		return t.Env
+	}
+	if i == 0 {
+		return "SUP_TUNNEL_PORT"
+	}
+	return fmt.Sprintf("SUP_TUNNEL_PORT_%d", i)
+}
+
+// Tunnels is a set of opened port forwards.
+type Tunnels struct {
+	listeners []net.Listener
+	env       EnvList
+	added     []*Tunnels // Tunnels merged by Add.
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool // Accepted connections, closed by Close.
+	closed bool
+}
+
+// OpenTunnels starts listening on the local ports and forwards every
+// accepted connection to the remote address via the SSH connection.
+func (c *SSHClient) OpenTunnels(tunnels []Tunnel) (*Tunnels, error) {
+	if !c.connOpened {
+		return nil, fmt.Errorf("tunnel: not connected to %v", c.host)
+	}
+
+	t := &Tunnels{}
+	for i, tunnel := range tunnels {
+		if tunnel.Remote == "" {
+			t.Close()
+			return nil, fmt.Errorf("tunnel: remote address of local port %v not set", tunnel.Local)
+		}
+
+		listener, err := net.Listen("tcp", tunnelAddr(tunnel.Local))
+		if err != nil {
+			t.Close()
+			return nil, errors.Wrap(err, "tunnel: listening on "+tunnelAddr(tunnel.Local)+" failed")
+		}
+		t.listeners = append(t.listeners, listener)
+
+		port := listener.Addr().(*net.TCPAddr).Port
+		t.env.Set(tunnel.envName(i), strconv.Itoa(port))
+
+		remote := tunnel.Remote
+		go t.serve(listener, func(local net.Conn) {
+			conn, err := c.conn.Dial("tcp", remote)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", errors.Wrap(err, "tunnel: dialing "+remote+" via "+c.host+" failed"))
+				return
+			}
+			defer conn.Close()
+
+			pipe(local, conn)
+		})
+	}
+
+	return t, nil
+}
+
+// ForwardRemote makes the remote host listen on the tunnels' remote
+// addresses and forwards every accepted connection to the local addresses.
+func (c *SSHClient) ForwardRemote(tunnels []Tunnel) (*Tunnels, error) {
+	if !c.connOpened {
+		return nil, fmt.Errorf("remote forward: not connected to %v", c.host)
+	}
+
+	t := &Tunnels{}
+	for _, tunnel := range tunnels {
+		if tunnel.Local == "" {
+			t.Close()
+			return nil, fmt.Errorf("remote forward: local address of remote port %v not set", tunnel.Remote)
+		}
+
+		listener, err := c.conn.Listen("tcp", tunnelAddr(tunnel.Remote))
+		if err != nil {
+			t.Close()
+			return nil, errors.Wrap(err, "remote forward: listening on "+c.host+" "+tunnelAddr(tunnel.Remote)+" failed")
+		}
+		t.listeners = append(t.listeners, listener)
+
+		local := tunnelAddr(tunnel.Local)
+		go t.serve(listener, func(remote net.Conn) {
+			conn, err := net.Dial("tcp", local)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", errors.Wrap(err, "remote forward: dialing "+local+" failed"))
+				return
+			}
+			defer conn.Close()
+
+			pipe(remote, conn)
+		})
+	}
+
+	return t, nil
+}
+
+// ServeProxy makes the remote host listen on addr and serves a SOCKS5/HTTP
+// proxy on it, dialing the requested addresses from localhost.
+func (c *SSHClient) ServeProxy(addr string) (*Tunnels, error) {
+	if !c.connOpened {
+		return nil, fmt.Errorf("proxy: not connected to %v", c.host)
+	}
+
+	listener, err := c.conn.Listen("tcp", tunnelAddr(addr))
+	if err != nil {
+		return nil, errors.Wrap(err, "proxy: listening on "+c.host+" "+tunnelAddr(addr)+" failed")
+	}
+	t := &Tunnels{listeners: []net.Listener{listener}}
+	go t.serve(listener, serveProxy)
+
+	return t, nil
+}
+
+// serve accepts connections until the listener is closed and handles
+// each of them in a new goroutine. The connections are tracked, so that
+// Close closes them, and with them the connections piped to.
+func (t *Tunnels) serve(listener net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			conn.Close()
+			return
+		}
+		if t.conns == nil {
+			t.conns = map[net.Conn]bool{}
+		}
+		t.conns[conn] = true
+		t.mu.Unlock()
+
+		go func(conn net.Conn) {
+			defer func() {
+				t.mu.Lock()
+				delete(t.conns, conn)
+				t.mu.Unlock()
+			}()
+			defer conn.Close()
+			handle(conn)
+		}(conn)
+	}
+}
+
+// pipe copies data between two connections in both directions
+// until one of them is closed.
+func pipe(a, b io.ReadWriter) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// AsExport returns the env vars exposing the bound local ports
+// as bash export statements.
+func (t *Tunnels) AsExport() string {
+	return t.env.AsExport()
+}
+
+// Add merges other tunnels, so they can be closed at once.
+func (t *Tunnels) Add(other *Tunnels) {
+	t.added = append(t.added, other)
+	t.env = append(t.env, other.env...)
+}
+
+// Close stops listening on all the ports and closes the accepted connections.
+func (t *Tunnels) Close() error {
+	var err error
+	for _, listener := range t.listeners {
+		if e := listener.Close(); e != nil {
+			err = e
+		}
+	}
+	t.listeners = nil
+
+	t.mu.Lock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+
+	for _, other := range t.added {
+		if e := other.Close(); e != nil {
+			err = e
+		}
+	}
+	t.added = nil
+	return err
+}
@@ -0,0 +1,413 @@
+package sup
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// Problem is a problem of a Supfile found by Validate.
+type Problem struct {
+	Line    int // Line of the problem, counted from 1, or 0 if unknown.
+	Column  int // Column of the problem, counted from 1, or 0 if unknown.
+	Message string
+}
+
+func (p Problem) Error() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("%v:%v: %v", p.Line, p.Column, p.Message)
+}
+
+// Validate checks the Supfile's data and returns all of its problems, in order
+// of their position: YAML syntax errors, unknown and duplicate keys, values
+// of wrong types, targets including unknown commands or targets, commands
+// without anything to run, and the errors returned by NewSupfile.
+func Validate(data []byte) []Problem {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		return []Problem{yamlProblem(err)}
+	}
+	if len(doc.Content) == 0 {
+		return []Problem{{Message: "empty Supfile"}}
+	}
+
+	v := &validator{}
+	root := resolveAlias(doc.Content[0])
+	v.check(root, reflect.TypeOf(Supfile{}), "")
+	if root.Kind == yaml3.MappingNode {
+		v.checkNames(root)
+	}
+
+	// Problems found by NewSupfile, ie. dependency cycles, invalid release
+	// options etc., are reported only if the Supfile is otherwise fine.
+	if len(v.problems) == 0 {
+		if _, err := NewSupfile(data); err != nil {
+			v.problems = append(v.problems, Problem{Message: err.Error()})
+		}
+	}
+
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		a, b := v.problems[i], v.problems[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return v.problems
+}
+
+var yamlErrorRegexp = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// yamlProblem returns problem of the YAML syntax error.
+func yamlProblem(err error) Problem {
+	m := yamlErrorRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return Problem{Message: err.Error()}
+	}
+	line, _ := strconv.Atoi(m[1])
+	return Problem{Line: line, Column: 1, Message: m[2]}
+}
+
+// validator collects problems of the Supfile's nodes.
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) add(n *yaml3.Node, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Line:    n.Line,
+		Column:  n.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Types with custom YAML unmarshalling.
+var (
+	networksType = reflect.TypeOf(Networks{})
+	commandsType = reflect.TypeOf(Commands{})
+	targetsType  = reflect.TypeOf(Targets{})
+	targetType   = reflect.TypeOf(Target{})
+	envListType  = reflect.TypeOf(EnvList{})
+	serialType   = reflect.TypeOf(Serial{})
+	lockType     = reflect.TypeOf(Lock{})
+)
+
+// check checks the node against the type it's unmarshalled to.
+// Path describes the node in the messages, ie. "commands.deploy".
+func (v *validator) check(n *yaml3.Node, t reflect.Type, path string) {
+	n = resolveAlias(n)
+	if n.Tag == "!!null" {
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case networksType, commandsType, targetsType:
+		elem := map[reflect.Type]reflect.Type{
+			networksType: reflect.TypeOf(Network{}),
+			commandsType: reflect.TypeOf(Command{}),
+			targetsType:  targetType,
+		}[t]
+		if v.expect(n, yaml3.MappingNode, path, "a map") {
+			for _, kv := range v.pairs(n, path) {
+				v.check(kv[1], elem, keyPath(path, kv[0].Value))
+			}
+		}
+		return
+
+	case envListType:
+		if v.expect(n, yaml3.MappingNode, path, "a map of env vars") {
+			for _, kv := range v.pairs(n, path) {
+				v.expect(kv[1], yaml3.ScalarNode, keyPath(path, kv[0].Value), "a value")
+			}
+		}
+		return
+
+	case serialType:
+		if n.Kind == yaml3.SequenceNode {
+			for _, item := range n.Content {
+				v.expect(item, yaml3.ScalarNode, path, "a batch size")
+			}
+			return
+		}
+		v.expect(n, yaml3.ScalarNode, path, "a batch size or a list of batch sizes")
+		return
+
+	case targetType:
+		if n.Kind == yaml3.SequenceNode {
+			v.check(n, reflect.TypeOf([]string{}), path)
+			return
+		}
+
+	case lockType:
+		if n.Kind == yaml3.ScalarNode {
+			return // lock: true, or lock: /path/to/lock
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if !v.expect(n, yaml3.MappingNode, path, "a map") {
+			return
+		}
+		fields := yamlFields(t)
+		for _, kv := range v.pairs(n, path) {
+			key := kv[0].Value
+			field, ok := fields[key]
+			if !ok {
+				v.unknownKey(kv[0], path, fields)
+				continue
+			}
+			v.check(kv[1], field, keyPath(path, key))
+		}
+
+	case reflect.Slice:
+		if !v.expect(n, yaml3.SequenceNode, path, "a list") {
+			return
+		}
+		for _, item := range n.Content {
+			v.check(item, t.Elem(), path)
+		}
+
+	case reflect.Bool:
+		if v.expect(n, yaml3.ScalarNode, path, "a boolean") {
+			switch strings.ToLower(n.Value) {
+			case "true", "false", "yes", "no", "on", "off", "y", "n":
+			default:
+				v.add(n, "%v: expected a boolean, got %q", describePath(path), n.Value)
+			}
+		}
+
+	case reflect.Int:
+		if v.expect(n, yaml3.ScalarNode, path, "a number") {
+			if _, err := strconv.Atoi(n.Value); err != nil {
+				v.add(n, "%v: expected a number, got %q", describePath(path), n.Value)
+			}
+		}
+
+	default:
+		v.expect(n, yaml3.ScalarNode, path, "a value")
+	}
+}
+
+// expect reports whether the node is of the kind, adding a problem if not.
+func (v *validator) expect(n *yaml3.Node, kind yaml3.Kind, path, what string) bool {
+	n = resolveAlias(n)
+	if n.Kind == kind {
+		return true
+	}
+	v.add(n, "%v: expected %v, got %v", describePath(path), what, kindName(n))
+	return false
+}
+
+// pairs returns key and value nodes of the mapping, including the merged
+// mappings, adding problems of the duplicate keys.
+func (v *validator) pairs(n *yaml3.Node, path string) [][2]*yaml3.Node {
+	var pairs [][2]*yaml3.Node
+	seen := map[string]*yaml3.Node{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], resolveAlias(n.Content[i+1])
+		if key.Tag == "!!merge" {
+			if value.Kind == yaml3.MappingNode {
+				pairs = append(pairs, v.pairs(value, path)...)
+			}
+			continue
+		}
+		if first, ok := seen[key.Value]; ok {
+			v.add(key, "%v: duplicate key %q, first defined at line %v", describePath(path), key.Value, first.Line)
+			continue
+		}
+		seen[key.Value] = key
+		pairs = append(pairs, [2]*yaml3.Node{key, value})
+	}
+	return pairs
+}
+
+// unknownKey adds problem of the unknown key, suggesting the similar one.
+func (v *validator) unknownKey(key *yaml3.Node, path string, fields map[string]reflect.Type) {
+	best, bestDist := "", 3
+	for name := range fields {
+		if d := editDistance(key.Value, name); d < bestDist || (d == bestDist && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	if best != "" {
+		v.add(key, "%v: unknown key %q, did you mean %q?", describePath(path), key.Value, best)
+		return
+	}
+	v.add(key, "%v: unknown key %q", describePath(path), key.Value)
+}
+
+// checkNames checks the names referenced by the commands and targets.
+func (v *validator) checkNames(root *yaml3.Node) {
+	commands := mappingValue(root, "commands")
+	targets := mappingValue(root, "targets")
+	isCommand := func(name string) bool { return mappingValue(commands, name) != nil }
+	isTarget := func(name string) bool { return mappingValue(targets, name) != nil }
+
+	if commands != nil && commands.Kind == yaml3.MappingNode {
+		for i := 0; i+1 < len(commands.Content); i += 2 {
+			key, cmd := commands.Content[i], resolveAlias(commands.Content[i+1])
+			if cmd.Kind != yaml3.MappingNode {
+				continue
+			}
+			path := keyPath("commands", key.Value)
+
+			runs := false
+			for _, name := range []string{"run", "local", "script", "upload", "release"} {
+				if mappingValue(cmd, name) != nil {
+					runs = true
+				}
+			}
+			if !runs {
+				v.add(key, "%v: nothing to run, expected run, local, script, upload or release", path)
+			}
+
+			if deps := mappingValue(cmd, "depends_on"); deps != nil && deps.Kind == yaml3.SequenceNode {
+				for _, dep := range deps.Content {
+					if !isCommand(dep.Value) {
+						v.add(dep, "%v: unknown depends_on command %q", path, dep.Value)
+					}
+				}
+			}
+		}
+	}
+
+	if targets != nil && targets.Kind == yaml3.MappingNode {
+		for i := 0; i+1 < len(targets.Content); i += 2 {
+			key, target := targets.Content[i], resolveAlias(targets.Content[i+1])
+			path := keyPath("targets", key.Value)
+
+			items := target
+			if target.Kind == yaml3.MappingNode {
+				items = mappingValue(target, "commands")
+				if items == nil {
+					v.add(key, "%v: no commands", path)
+				}
+				if onFailure := mappingValue(target, "on_failure"); onFailure != nil && onFailure.Kind == yaml3.ScalarNode {
+					if !isTarget(onFailure.Value) {
+						v.add(onFailure, "%v: unknown on_failure target %q", path, onFailure.Value)
+					}
+				}
+			}
+			if items == nil || items.Kind != yaml3.SequenceNode {
+				continue
+			}
+			for _, item := range items.Content {
+				if item.Kind == yaml3.ScalarNode && !isCommand(item.Value) && !isTarget(item.Value) {
+					v.add(item, "%v: unknown command or target %q", path, item.Value)
+				}
+			}
+		}
+	}
+}
+
+// yamlFields returns types of the struct's fields by their YAML keys.
+// Fields without a tag use the lowercased field name, as yaml.v2 does.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // Unexported.
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// mappingValue returns value of the key in the mapping, or nil.
+func mappingValue(n *yaml3.Node, key string) *yaml3.Node {
+	if n == nil {
+		return nil
+	}
+	n = resolveAlias(n)
+	if n.Kind != yaml3.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return resolveAlias(n.Content[i+1])
+		}
+	}
+	return nil
+}
+
+func resolveAlias(n *yaml3.Node) *yaml3.Node {
+	for n.Kind == yaml3.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+func kindName(n *yaml3.Node) string {
+	switch n.Kind {
+	case yaml3.MappingNode:
+		return "a map"
+	case yaml3.SequenceNode:
+		return "a list"
+	default:
+		return fmt.Sprintf("%q", n.Value)
+	}
+}
+
+func keyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "Supfile"
+	}
+	return path
+}
+
+// editDistance returns Levenshtein distance of the strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,210 @@
+package sup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WaitFor is a health check polled on every host after the command
+// (or its serial batch) finishes, until it passes or times out.
+type WaitFor struct {
+	Run      string `yaml:"run"`      // Remote command, that must exit with zero status.
+	Local    string `yaml:"local"`    // Local command, that must exit with zero status.
+	URL      string `yaml:"url"`      // URL fetched through the host's connection, that must respond with 2xx.
+	Timeout  string `yaml:"timeout"`  // Defaults to 60s.
+	Interval string `yaml:"interval"` // Defaults to 2s.
+}
+
+func (w *WaitFor) validate() error {
+	checks := 0
+	for _, check := range []string{w.Run, w.Local, w.URL} {
+		if check != "" {
+			checks++
+		}
+	}
+	if checks != 1 {
+		return errors.New("wait_for: exactly one of run, local or url must be set")
+	}
+
+	for _, d := range []string{w.Timeout, w.Interval} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return errors.Wrap(err, "wait_for")
+		}
+	}
+	return nil
+}
+
+// durations returns timeout and interval of the check.
+func (w *WaitFor) durations() (time.Duration, time.Duration) {
+	timeout, interval := 60*time.Second, 2*time.Second
+	if w.Timeout != "" {
+		timeout, _ = time.ParseDuration(w.Timeout) // Validated by NewSupfile.
+	}
+	if w.Interval != "" {
+		interval, _ = time.ParseDuration(w.Interval)
+	}
+	return timeout, interval
+}
+
+// waitFor polls the command's health check on all the clients
+// in parallel, until it passes on all of them or times out.
+func (r *runner) waitFor(cmd *Command, clients []Client) error {
+	timeout, interval := cmd.WaitFor.durations()
+	deadline := time.Now().Add(timeout)
+
+	var wg sync.WaitGroup
+	failures := make(chan Client, len(clients))
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			for {
+				err := r.check(cmd.WaitFor, c)
+				if err == nil {
+					return
+				}
+				if time.Now().Add(interval).After(deadline) {
+					fmt.Fprintf(os.Stderr, "%swait_for timed out after %v: %v\n", r.prefix(c), timeout, err)
+					failures <- c
+					return
+				}
+				time.Sleep(interval)
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(failures)
+
+	if len(failures) > 0 {
+		var failed []Client
+		for c := range failures {
+			failed = append(failed, c)
+		}
+		r.fail(failed)
+		return errors.Wrap(ErrTaskFailed{Failed: len(failed), ExitStatus: 1}, cmd.Name+": wait_for failed")
+	}
+	return nil
+}
+
+// check runs the health check once.
+func (r *runner) check(w *WaitFor, c Client) error {
+	switch {
+	case w.URL != "":
+		return r.checkURL(w.URL, c)
+
+	case w.Local != "":
+		cmd := exec.Command("bash", "-c", r.env+`export SUP_HOST="`+r.host(c)+`";`+w.Local)
+		return withOutput(cmd.CombinedOutput())
+
+	default:
+		return checkRemote(w.Run, c)
+	}
+}
+
+// checkRemote runs the command on the idle client.
+func checkRemote(run string, c Client) error {
+	return withOutput(runRemote(run, c))
+}
+
+// runRemote runs the command on the idle client
+// and returns its combined output.
+func runRemote(run string, c Client) ([]byte, error) {
+	if err := c.Run(&Task{Run: run, Clients: []Client{c}}); err != nil {
+		return nil, err
+	}
+	c.Stdin().Close()
+
+	var stdout, stderr []byte
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stdout, _ = ioutil.ReadAll(c.Stdout())
+	}()
+	go func() {
+		defer wg.Done()
+		stderr, _ = ioutil.ReadAll(c.Stderr())
+	}()
+	wg.Wait()
+
+	return append(stdout, stderr...), c.Wait()
+}
+
+// checkURL fetches the URL through the client's connection. $VARs in the URL
+// are expanded, so "http://localhost:$PORT/health" is the host's own port.
+func (r *runner) checkURL(url string, c Client) error {
+	url = os.Expand(url, func(key string) string {
+		if key == "SUP_HOST" {
+			return r.host(c)
+		}
+		for _, v := range r.vars {
+			if v.Key == key {
+				return v.Value
+			}
+		}
+		return os.Getenv(key)
+	})
+
+	dial := dialerOf(c)
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+				return dial(network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %v: %v", url, resp.Status)
+	}
+	return nil
+}
+
+// dialerOf returns function dialing addresses from the client's host.
+func dialerOf(c Client) func(network, addr string) (net.Conn, error) {
+	switch c := c.(type) {
+	case *SSHClient:
+		return c.conn.Dial
+	case *DockerClient:
+		if ssh, ok := c.Client.(*SSHClient); ok {
+			return ssh.conn.Dial
+		}
+	}
+	return net.Dial
+}
+
+// withOutput annotates the error with the last line of the command's output.
+func withOutput(output []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	lines := strings.Split(string(bytes.TrimSpace(output)), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return fmt.Errorf("%v: %v", err, last)
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// filterHosts evaluates the command's "when" and "unless" conditions
+// on all the clients in parallel and returns the clients the command
+// should be run on. The skipped clients are reported.
+func (r *runner) filterHosts(cmd *Command, clients []Client) ([]Client, error) {
+	if cmd.When == "" && cmd.Unless == "" {
+		return clients, nil
+	}
+
+	var wg sync.WaitGroup
+	run := make([]bool, len(clients))
+	errs := make([]error, len(clients))
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			run[i], errs[i] = evalCondition(cmd, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	var filtered []Client
+	for i, c := range clients {
+		if errs[i] != nil {
+			return nil, errors.Wrap(errs[i], r.prefix(c)+cmd.Name+": evaluating condition failed")
+		}
+		if !run[i] {
+			fmt.Fprintf(os.Stderr, "%s%v: skipped\n", r.prefix(c), cmd.Name)
+			r.skip(cmd, c)
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered, nil
+}
+
+// evalCondition reports whether the command should be run on the client.
+func evalCondition(cmd *Command, c Client) (bool, error) {
+	if cmd.When != "" {
+		ok, err := evalRemote(cmd.When, c)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if cmd.Unless != "" {
+		ok, err := evalRemote(cmd.Unless, c)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// evalRemote runs the condition on the client and reports whether it exited
+// with zero status. Failures other than non-zero exit status are returned.
+func evalRemote(condition string, c Client) (bool, error) {
+	output, err := runRemote(condition, c)
+	switch err.(type) {
+	case nil:
+		return true, nil
+	case *ssh.ExitError, *exec.ExitError:
+		return false, nil
+	default:
+		return false, withOutput(output, err)
+	}
+}
+
+var whenEnvRegexp = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*(?:(==|!=)\s*(.*?))?\s*$`)
+
+// parseWhenEnv parses condition of the form "KEY == value", "KEY != value"
+// or "KEY" (meaning KEY is not empty).
+func parseWhenEnv(condition string) (key, op, value string, err error) {
+	m := whenEnvRegexp.FindStringSubmatch(condition)
+	if m == nil {
+		return "", "", "", fmt.Errorf("when_env: invalid condition %q", condition)
+	}
+	key, op, value = m[1], m[2], m[3]
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return key, op, value, nil
+}
+
+// evalWhenEnv evaluates the when_env condition locally against the env vars.
+func evalWhenEnv(condition, env string) (bool, error) {
+	key, op, value, err := parseWhenEnv(condition)
+	if err != nil {
+		return false, err
+	}
+
+	var test string
+	switch op {
+	case "==":
+		test = fmt.Sprintf(`[ "$%v" = %v ]`, key, shellQuote(value))
+	case "!=":
+		test = fmt.Sprintf(`[ "$%v" != %v ]`, key, shellQuote(value))
+	default:
+		test = fmt.Sprintf(`[ -n "$%v" ]`, key)
+	}
+
+	err = exec.Command("bash", "-c", env+test).Run()
+	switch err.(type) {
+	case nil:
+		return true, nil
+	case *exec.ExitError:
+		return false, nil
+	default:
+		return false, errors.Wrap(err, "when_env")
+	}
+}